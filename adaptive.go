@@ -0,0 +1,98 @@
+package gitbase
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	// adaptiveConfidence is the confidence level of the wall time interval
+	// used to decide if a query is stable.
+	adaptiveConfidence = 0.95
+	// adaptiveMinRuns is the minimum number of runs needed to compute the
+	// interval.
+	adaptiveMinRuns = minStatRuns
+)
+
+// ErrInvalidAdaptive is returned when the adaptive repetition limits are
+// not valid.
+var ErrInvalidAdaptive = errors.NewKind("invalid adaptive %s %v")
+
+// validAdaptive checks the adaptive limits. The maximum repetitions can not
+// be lower than the configured ones.
+func validAdaptive(o Options, repeat int) error {
+	if !o.Adaptive {
+		return nil
+	}
+
+	if o.AdaptiveWidth <= 0 {
+		return ErrInvalidAdaptive.New("width", o.AdaptiveWidth)
+	}
+
+	if o.AdaptiveMax < 1 || o.AdaptiveMax < repeat {
+		return ErrInvalidAdaptive.New(
+			"max", fmt.Sprintf("%d, it must be at least --repeat %d", o.AdaptiveMax, repeat))
+	}
+
+	return nil
+}
+
+// wallWidth returns the width of the confidence interval of the median wall
+// time of the successful runs as a percentage of the median. It is +Inf
+// when there are not enough runs.
+func wallWidth(rs []*Result) float64 {
+	walls := metricValues(rs, MetricWall)
+	if len(walls) < adaptiveMinRuns {
+		return math.Inf(1)
+	}
+
+	m := median(walls)
+	if m == 0 {
+		return 0
+	}
+
+	low, high := medianCI(walls, adaptiveConfidence)
+	return (high - low) / m * 100
+}
+
+// repeat returns true when a query must run again. The query runs the
+// configured repetitions and, in adaptive mode, keeps running until its
+// wall time is stable or the maximum repetitions or time since start are
+// reached. A failed run stops the repetitions.
+func (t *Test) repeat(l log.Logger, rs []*Result, times int, start time.Time) bool {
+	if len(rs) > 0 && rs[len(rs)-1].Status != StatusOK {
+		return false
+	}
+
+	if len(rs) < times {
+		return true
+	}
+
+	if !t.options.Adaptive {
+		return false
+	}
+
+	width := wallWidth(rs)
+	fields := log.Fields{
+		"runs":  len(rs),
+		"width": width,
+	}
+
+	switch {
+	case width <= t.options.AdaptiveWidth:
+		l.With(fields).Debugf("Query wall time is stable")
+		return false
+	case len(rs) >= t.options.AdaptiveMax:
+		l.With(fields).Warningf("Maximum repetitions reached before wall time is stable")
+		return false
+	case t.options.AdaptiveTime > 0 && time.Since(start) >= t.options.AdaptiveTime:
+		l.With(fields).Warningf("Time budget reached before wall time is stable")
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,58 @@
+package gitbase
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func TestWallWidth(t *testing.T) {
+	require := require.New(t)
+
+	require.True(math.IsInf(wallWidth(wallResults(100, 100)), 1))
+	require.Equal(0.0, wallWidth(wallResults(100, 100, 100)))
+
+	stable := wallWidth(wallResults(100, 101, 99, 100, 101, 99, 100))
+	noisy := wallWidth(wallResults(100, 150, 60, 120, 80, 200, 50))
+	require.True(stable < 5)
+	require.True(noisy > 5)
+}
+
+func TestRepeat(t *testing.T) {
+	require := require.New(t)
+
+	l := log.New(nil)
+	test := &Test{}
+	now := time.Now()
+
+	require.True(test.repeat(l, wallResults(100, 150), 3, now))
+	require.False(test.repeat(l, wallResults(100, 150, 60), 3, now))
+
+	test.options = Options{
+		Adaptive:      true,
+		AdaptiveWidth: 5,
+		AdaptiveMax:   5,
+		AdaptiveTime:  time.Minute,
+	}
+
+	require.NoError(validAdaptive(test.options, 3))
+	require.True(ErrInvalidAdaptive.Is(validAdaptive(test.options, 6)))
+	require.True(test.repeat(l, wallResults(100, 150, 60), 3, now))
+	require.False(test.repeat(l, wallResults(100, 100, 100), 3, now))
+	require.False(test.repeat(l, wallResults(100, 150, 60, 120, 80), 3, now))
+	require.False(test.repeat(l, wallResults(100, 150, 60), 3, now.Add(-time.Hour)))
+
+	// failed runs without error are not repeated
+	failed := wallResults(100, 150)
+	failed[1].Status = StatusError
+	require.False(test.repeat(l, failed, 3, now))
+	failed = wallResults(100, 150, 60, 120)
+	failed[3].Status = StatusTimeout
+	require.False(test.repeat(l, failed, 3, now))
+
+	test.options.AdaptiveWidth = 0
+	require.True(ErrInvalidAdaptive.Is(validAdaptive(test.options, 3)))
+}
@@ -0,0 +1,70 @@
+package gitbase
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadVersionArgs reads a YAML file mapping versions, as given in the
+// command line, to extra gitbase server arguments.
+func loadVersionArgs(file string) (map[string][]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var args map[string][]string
+	err = yaml.Unmarshal(text, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+// versionArgs returns the extra server arguments of a version. Arguments
+// common to all the versions go first.
+func (t *Test) versionArgs(version string) []string {
+	var args []string
+	args = append(args, t.options.GitbaseArgs...)
+	args = append(args, t.fileArgs[version]...)
+
+	return args
+}
+
+// printArgs shows the extra server arguments of two versions if any of
+// them has them.
+func (t *Test) printArgs(versionA, versionB string) {
+	a := t.versionArgs(versionA)
+	b := t.versionArgs(versionB)
+	if len(a) == 0 && len(b) == 0 {
+		return
+	}
+
+	fmt.Printf("# Arguments: %s -> %s\n", formatArgs(a), formatArgs(b))
+}
+
+// formatArgs quotes the arguments that contain spaces.
+func formatArgs(args []string) string {
+	if len(args) == 0 {
+		return "none"
+	}
+
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\"'") {
+			a = strconv.Quote(a)
+		}
+		quoted[i] = a
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,44 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionArgs(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "args.yml")
+	err = ioutil.WriteFile(path, []byte(`
+v0.24.0: [--parallelism, "4"]
+remote:master: [--readonly]
+`), 0644)
+	require.NoError(err)
+
+	fileArgs, err := loadVersionArgs(path)
+	require.NoError(err)
+
+	test := &Test{
+		fileArgs: fileArgs,
+		options:  Options{GitbaseArgs: []string{"-v"}},
+	}
+
+	require.Equal([]string{"-v", "--parallelism", "4"}, test.versionArgs("v0.24.0"))
+	require.Equal([]string{"-v", "--readonly"}, test.versionArgs("remote:master"))
+	require.Equal([]string{"-v"}, test.versionArgs("latest"))
+}
+
+func TestFormatArgs(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("none", formatArgs(nil))
+	require.Equal(`--user-name "a b" x`, formatArgs([]string{"--user-name", "a b", "x"}))
+}
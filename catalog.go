@@ -0,0 +1,196 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// ErrNoQueries is returned when the builtin queries are replaced but no
+// query files were provided.
+var ErrNoQueries = errors.NewKind("no query files provided to replace gitbase queries")
+
+// loadCatalog returns the queries to run. The queries from gitbase
+// regression file are merged with the ones from paths, or replaced by them
+// if replace is true. When two queries have the same ID the one loaded
+// later wins, so files from paths take precedence over gitbase ones and
+// among them the last one provided wins.
+func loadCatalog(l log.Logger, builtin string, paths []string, replace bool) ([]Query, error) {
+	var queries []Query
+	if replace {
+		if len(paths) == 0 {
+			return nil, ErrNoQueries.New()
+		}
+	} else {
+		q, err := loadQueriesYaml(builtin)
+		if err != nil {
+			return nil, err
+		}
+
+		queries = q
+	}
+
+	for _, p := range paths {
+		files, err := queryFiles(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			extra, err := loadQueriesYaml(f)
+			if err != nil {
+				return nil, err
+			}
+
+			var overridden []string
+			queries, overridden = mergeQueries(queries, extra)
+			for _, id := range overridden {
+				l.With(log.Fields{
+					"query.ID": id,
+					"file":     f,
+				}).Warningf("Query overridden")
+			}
+		}
+	}
+
+	return queries, nil
+}
+
+// queryFiles returns the path if it is a file or the YAML files from it,
+// sorted by name, if it is a directory.
+func queryFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+
+		files = append(files, filepath.Join(path, e.Name()))
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// mergeQueries adds extra queries to base. Queries with an ID already in
+// base replace the old one keeping its position. It returns the merged
+// queries and the IDs that were replaced.
+func mergeQueries(base, extra []Query) ([]Query, []string) {
+	merged := make([]Query, len(base), len(base)+len(extra))
+	copy(merged, base)
+
+	positions := make(map[string]int, len(merged))
+	for i, q := range merged {
+		positions[q.ID] = i
+	}
+
+	var overridden []string
+	for _, q := range extra {
+		if i, ok := positions[q.ID]; ok {
+			merged[i] = q
+			overridden = append(overridden, q.ID)
+			continue
+		}
+
+		positions[q.ID] = len(merged)
+		merged = append(merged, q)
+	}
+
+	return merged, overridden
+}
+
+// unionQueries returns the queries from all the catalogs without repeated
+// IDs. Queries are in the order they first appear and the definition from
+// the last catalog containing them is used.
+func unionQueries(catalogs ...[]Query) []Query {
+	var union []Query
+	for _, c := range catalogs {
+		union, _ = mergeQueries(union, c)
+	}
+
+	return union
+}
+
+// CatalogChanges holds the IDs of the queries that differ between two
+// catalogs.
+type CatalogChanges struct {
+	// Added has the queries only in the second catalog.
+	Added []string
+	// Removed has the queries only in the first catalog.
+	Removed []string
+	// Changed has the queries with different statements.
+	Changed []string
+}
+
+// compareCatalogs returns the differences between two catalogs.
+func compareCatalogs(a, b []Query) CatalogChanges {
+	var changes CatalogChanges
+
+	queriesA := make(map[string]Query, len(a))
+	for _, q := range a {
+		queriesA[q.ID] = q
+	}
+
+	queriesB := make(map[string]Query, len(b))
+	for _, q := range b {
+		queriesB[q.ID] = q
+
+		qa, ok := queriesA[q.ID]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, q.ID)
+		case !sameStatements(qa, q):
+			changes.Changed = append(changes.Changed, q.ID)
+		}
+	}
+
+	for _, q := range a {
+		if _, ok := queriesB[q.ID]; !ok {
+			changes.Removed = append(changes.Removed, q.ID)
+		}
+	}
+
+	return changes
+}
+
+// sameStatements checks if two queries run the same statements, including
+// setup and teardown.
+func sameStatements(a, b Query) bool {
+	return equalStrings(a.Setup, b.Setup) &&
+		equalStrings(a.Statements, b.Statements) &&
+		equalStrings(a.Teardown, b.Teardown)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if strings.TrimSpace(a[i]) != strings.TrimSpace(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,117 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func TestLoadCatalog(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(ioutil.WriteFile(path, []byte(text), 0644))
+		return path
+	}
+
+	builtin := write("builtin.yml", `
+- ID: a
+  Statements: [select 1]
+- ID: b
+  Statements: [select 2]
+`)
+
+	extra := filepath.Join(dir, "extra")
+	require.NoError(os.Mkdir(extra, 0755))
+	write("extra/1.yml", `
+- ID: b
+  Statements: [select 3]
+- ID: c
+  Statements: [select 4]
+`)
+	write("extra/2.yaml", `
+- ID: c
+  Statements: [select 5]
+`)
+	write("extra/ignored.txt", "not yaml")
+
+	l := log.New(nil)
+
+	queries, err := loadCatalog(l, builtin, []string{extra}, false)
+	require.NoError(err)
+	require.Equal([]Query{
+		{ID: "a", Statements: []string{"select 1"}},
+		{ID: "b", Statements: []string{"select 3"}},
+		{ID: "c", Statements: []string{"select 5"}},
+	}, queries)
+
+	queries, err = loadCatalog(l, "missing.yml", []string{filepath.Join(extra, "1.yml")}, true)
+	require.NoError(err)
+	require.Len(queries, 2)
+
+	_, err = loadCatalog(l, builtin, nil, true)
+	require.True(ErrNoQueries.Is(err))
+}
+
+func TestCompareCatalogs(t *testing.T) {
+	require := require.New(t)
+
+	a := []Query{
+		{ID: "a", Statements: []string{"select 1"}},
+		{ID: "b", Statements: []string{"select 2"}},
+		{ID: "c", Statements: []string{"select 3"}},
+	}
+	b := []Query{
+		{ID: "b", Statements: []string{" select 2\n"}},
+		{ID: "c", Statements: []string{"select 4"}},
+		{ID: "d", Statements: []string{"select 5"}},
+	}
+
+	require.Equal(CatalogChanges{
+		Added:   []string{"d"},
+		Removed: []string{"a"},
+		Changed: []string{"c"},
+	}, compareCatalogs(a, b))
+
+	var ids []string
+	for _, q := range unionQueries(a, b) {
+		ids = append(ids, q.ID)
+	}
+	require.Equal([]string{"a", "b", "c", "d"}, ids)
+}
+
+func TestCompareCatalogsSetup(t *testing.T) {
+	require := require.New(t)
+
+	query := Query{
+		ID:         "a",
+		Setup:      []string{"SET inmemory_joins = 1"},
+		Statements: []string{"select 1"},
+		Teardown:   []string{"SET inmemory_joins = 0"},
+	}
+
+	setup := query
+	setup.Setup = []string{"SET inmemory_joins = 0"}
+	require.False(sameStatements(query, setup))
+
+	teardown := query
+	teardown.Teardown = nil
+	require.False(sameStatements(query, teardown))
+
+	spaces := query
+	spaces.Setup = []string{" SET inmemory_joins = 1\n"}
+	require.True(sameStatements(query, spaces))
+
+	require.Equal(CatalogChanges{
+		Changed: []string{"a"},
+	}, compareCatalogs([]Query{query}, []Query{setup}))
+}
@@ -0,0 +1,99 @@
+package gitbase
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+)
+
+// Checksum identifies the contents of the rows returned by a query.
+type Checksum struct {
+	// Ordered depends on the contents of the rows and the order in which
+	// they were returned.
+	Ordered string
+	// Unordered only depends on the contents of the rows.
+	Unordered string
+}
+
+// Equal checks if two checksums match. When ordered is false the order of
+// the rows is not taken into account.
+func (c Checksum) Equal(o Checksum, ordered bool) bool {
+	if ordered {
+		return c.Ordered == o.Ordered
+	}
+
+	return c.Unordered == o.Unordered
+}
+
+// Short returns an abbreviated form of the checksum suitable for reports.
+func (c Checksum) Short(ordered bool) string {
+	s := c.Unordered
+	if ordered {
+		s = c.Ordered
+	}
+
+	if len(s) > 16 {
+		return s[:16]
+	}
+
+	return s
+}
+
+// hasher calculates the checksums of the rows of one or more statements.
+type hasher struct {
+	statement int
+	ordered   hash.Hash
+	unordered [sha256.Size]byte
+}
+
+func newHasher() *hasher {
+	return &hasher{ordered: sha256.New()}
+}
+
+// next marks the start of the rows of a new statement so rows returned by
+// different statements never hash the same.
+func (h *hasher) next() {
+	h.statement++
+}
+
+// add hashes a row. NULL values are distinct from empty strings.
+func (h *hasher) add(values []sql.RawBytes) {
+	row := sha256.New()
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(h.statement))
+	row.Write(buf[:])
+
+	for _, v := range values {
+		if v == nil {
+			row.Write([]byte{0})
+			continue
+		}
+
+		row.Write([]byte{1})
+		binary.BigEndian.PutUint64(buf[:], uint64(len(v)))
+		row.Write(buf[:])
+		row.Write(v)
+	}
+
+	sum := row.Sum(nil)
+	h.ordered.Write(sum)
+
+	// The unordered checksum is the sum modulo 2^256 of the row hashes,
+	// which does not depend on the order and keeps duplicated rows.
+	var carry uint16
+	for i := sha256.Size - 1; i >= 0; i-- {
+		carry += uint16(h.unordered[i]) + uint16(sum[i])
+		h.unordered[i] = byte(carry)
+		carry >>= 8
+	}
+}
+
+func (h *hasher) sum() Checksum {
+	return Checksum{
+		Ordered:   hex.EncodeToString(h.ordered.Sum(nil)),
+		Unordered: hex.EncodeToString(h.unordered[:]),
+	}
+}
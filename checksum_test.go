@@ -0,0 +1,46 @@
+package gitbase
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func hashRows(rows ...[]sql.RawBytes) Checksum {
+	h := newHasher()
+	h.next()
+	for _, r := range rows {
+		h.add(r)
+	}
+
+	return h.sum()
+}
+
+func TestChecksum(t *testing.T) {
+	require := require.New(t)
+
+	a := []sql.RawBytes{sql.RawBytes("a"), sql.RawBytes("1")}
+	b := []sql.RawBytes{sql.RawBytes("b"), sql.RawBytes("2")}
+
+	ab := hashRows(a, b)
+	ba := hashRows(b, a)
+
+	require.True(ab.Equal(ba, false))
+	require.False(ab.Equal(ba, true))
+	require.True(ab.Equal(hashRows(a, b), true))
+
+	// duplicated rows are not cancelled
+	require.False(hashRows(a, a).Equal(hashRows(), false))
+	require.False(hashRows(a).Equal(hashRows(a, a), false))
+
+	// NULL is different from an empty value
+	null := hashRows([]sql.RawBytes{nil})
+	empty := hashRows([]sql.RawBytes{sql.RawBytes{}})
+	require.False(null.Equal(empty, false))
+
+	// values are not concatenated
+	split := hashRows([]sql.RawBytes{sql.RawBytes("a"), sql.RawBytes("b")})
+	joined := hashRows([]sql.RawBytes{sql.RawBytes("ab"), sql.RawBytes("")})
+	require.False(split.Equal(joined, false))
+}
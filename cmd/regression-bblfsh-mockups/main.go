@@ -287,7 +287,7 @@ func prepareGitBaseEnvironment() (*gitbase.Test, error) {
 	}
 	config.Versions = args
 
-	test, err := gitbase.NewTest(config, gitServerConfig)
+	test, err := gitbase.NewTest(config, gitServerConfig, gitbase.Options{})
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +28,7 @@ The repositories and downloaded/built gitbase binaries are cached by default in
 type Options struct {
 	regression.Config
 	GitServerConfig regression.GitServerConfig
+	Options         gitbase.Options
 
 	CSV bool `long:"csv" description:"save csv files with last result"`
 
@@ -77,7 +78,7 @@ func main() {
 
 	config.Versions = args
 
-	test, err := gitbase.NewTest(config, gitServerConfig)
+	test, err := gitbase.NewTest(config, gitServerConfig, options.Options)
 	if err != nil {
 		panic(err)
 	}
@@ -89,6 +90,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	if options.Options.Clients > 0 {
+		err = test.RunConcurrent()
+		if err != nil {
+			panic(err)
+		}
+
+		if !test.GetConcurrentResults() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if options.Options.Indexes != "" {
+		err = test.RunIndexes()
+		if err != nil {
+			panic(err)
+		}
+
+		if !test.GetIndexResults() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	err = test.RunLoad()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,127 @@
+package gitbase
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// ErrParallel is returned when versions can not be run in parallel.
+var ErrParallel = errors.NewKind("can not run versions in parallel: %s")
+
+// pinCPUs splits the available processors in disjoint sets, one per
+// version, so parallel servers do not compete for them.
+func (t *Test) pinCPUs() (map[*regression.Binary][]int, error) {
+	if _, err := exec.LookPath("taskset"); err != nil {
+		return nil, ErrParallel.Wrap(err)
+	}
+
+	sets, err := splitCPUs(allowedCPUs(t.log), len(t.config.Versions))
+	if err != nil {
+		return nil, err
+	}
+
+	cpus := make(map[*regression.Binary][]int)
+	for i, version := range t.config.Versions {
+		gitbase, ok := t.gitbase[version]
+		if !ok {
+			panic("gitbase not initialized. Was Prepare called?")
+		}
+
+		t.log.With(log.Fields{
+			"version": version,
+			"cpus":    cpuList(sets[i]),
+		}).Infof("Pinning version")
+
+		cpus[gitbase] = sets[i]
+	}
+
+	return cpus, nil
+}
+
+// splitCPUs divides the processors in the given number of disjoint sets of
+// the same size.
+func splitCPUs(cpus []int, sets int) ([][]int, error) {
+	size := 0
+	if sets > 0 {
+		size = len(cpus) / sets
+	}
+
+	if size < 1 {
+		return nil, ErrParallel.New(
+			fmt.Sprintf("%d processors can not be split in %d sets", len(cpus), sets))
+	}
+
+	result := make([][]int, sets)
+	for i := range result {
+		result[i] = append([]int(nil), cpus[i*size:(i+1)*size]...)
+	}
+
+	return result, nil
+}
+
+// allowedCPUs returns the processors the process can run on, read from
+// /proc/self/status. When it can not be read all the processors are
+// returned.
+func allowedCPUs(l log.Logger) []int {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "Cpus_allowed_list:" {
+				continue
+			}
+
+			var cpus []int
+			cpus, err = parseCPUList(fields[1])
+			if err == nil {
+				return cpus
+			}
+		}
+	}
+
+	if err != nil {
+		l.Warningf("Could not read allowed processors, using all of them: %s", err)
+	}
+
+	cpus := make([]int, runtime.NumCPU())
+	for i := range cpus {
+		cpus[i] = i
+	}
+
+	return cpus
+}
+
+// parseCPUList reads a list of processors in the format used by the kernel
+// and taskset, for example "0-3,8,10-11".
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+
+	return cpus, nil
+}
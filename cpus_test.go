@@ -0,0 +1,33 @@
+package gitbase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCPUs(t *testing.T) {
+	require := require.New(t)
+
+	sets, err := splitCPUs([]int{0, 1, 2, 3, 4}, 2)
+	require.NoError(err)
+	require.Equal([][]int{{0, 1}, {2, 3}}, sets)
+
+	sets, err = splitCPUs([]int{2, 3, 6, 7}, 2)
+	require.NoError(err)
+	require.Equal([][]int{{2, 3}, {6, 7}}, sets)
+
+	_, err = splitCPUs([]int{0, 1}, 3)
+	require.True(ErrParallel.Is(err))
+}
+
+func TestParseCPUList(t *testing.T) {
+	require := require.New(t)
+
+	cpus, err := parseCPUList("0-3,8,10-11")
+	require.NoError(err)
+	require.Equal([]int{0, 1, 2, 3, 8, 10, 11}, cpus)
+
+	_, err = parseCPUList("0-a")
+	require.Error(err)
+}
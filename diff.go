@@ -0,0 +1,284 @@
+package gitbase
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Table holds the rows returned by a statement.
+type Table struct {
+	Columns []string
+	Rows    [][]sql.NullString
+	// Limit is the maximum number of rows saved.
+	Limit int
+	// Truncated is true when the statement returned more than Limit rows.
+	Truncated bool
+}
+
+func (t *Table) add(values []sql.RawBytes) {
+	if len(t.Rows) >= t.Limit {
+		t.Truncated = true
+		return
+	}
+
+	row := make([]sql.NullString, len(values))
+	for i, v := range values {
+		if v != nil {
+			row[i] = sql.NullString{String: string(v), Valid: true}
+		}
+	}
+
+	t.Rows = append(t.Rows, row)
+}
+
+// RowChange holds the old and new values of a row with the same key.
+type RowChange struct {
+	Old []sql.NullString
+	New []sql.NullString
+}
+
+// TableDiff holds the row differences between the results of a statement
+// in two versions.
+type TableDiff struct {
+	Statement int
+	ColumnsA  []string
+	ColumnsB  []string
+	Removed   [][]sql.NullString
+	Added     [][]sql.NullString
+	Changed   []RowChange
+	// Truncated is true when any of the results was truncated and the
+	// differences may be incomplete.
+	Truncated bool
+}
+
+// Empty returns true when there are no differences.
+func (d *TableDiff) Empty() bool {
+	return len(d.Removed) == 0 && len(d.Added) == 0 && len(d.Changed) == 0 &&
+		strings.Join(d.ColumnsA, ",") == strings.Join(d.ColumnsB, ",")
+}
+
+// sameCapturesMessage explains why two results with the same captured rows
+// have different checksums. It is empty when the checksums are equal.
+func sameCapturesMessage(a, b Checksum, diffs []*TableDiff) string {
+	if a.Equal(b, false) {
+		if a.Equal(b, true) {
+			return ""
+		}
+
+		return "rows returned in different order"
+	}
+
+	for _, d := range diffs {
+		if d.Truncated {
+			return "captured rows match, the difference is past the --diff-rows limit"
+		}
+	}
+
+	return "captured rows match but checksums differ"
+}
+
+// diffOutputs compares the captured tables of two outputs. Rows are matched
+// using the key columns or the whole row when there are no keys.
+func diffOutputs(a, b []*Table, key []string) []*TableDiff {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+
+	diffs := make([]*TableDiff, 0, n)
+	for i := 0; i < n; i++ {
+		ta, tb := &Table{}, &Table{}
+		if i < len(a) {
+			ta = a[i]
+		}
+		if i < len(b) {
+			tb = b[i]
+		}
+
+		d := diffTables(ta, tb, key)
+		d.Statement = i + 1
+		diffs = append(diffs, d)
+	}
+
+	return diffs
+}
+
+func diffTables(a, b *Table, key []string) *TableDiff {
+	d := &TableDiff{
+		ColumnsA:  a.Columns,
+		ColumnsB:  b.Columns,
+		Truncated: a.Truncated || b.Truncated,
+	}
+
+	keyA := keyColumns(a.Columns, key)
+	keyB := keyColumns(b.Columns, key)
+
+	pending := make(map[string][]int)
+	for i, r := range a.Rows {
+		k := rowKey(r, keyA)
+		pending[k] = append(pending[k], i)
+	}
+
+	matched := make([]bool, len(a.Rows))
+	for _, r := range b.Rows {
+		k := rowKey(r, keyB)
+		candidates := pending[k]
+		if len(candidates) == 0 {
+			d.Added = append(d.Added, r)
+			continue
+		}
+
+		// prefer an identical row when several share the same key
+		pick := 0
+		for j, i := range candidates {
+			if equalRows(a.Rows[i], r) {
+				pick = j
+				break
+			}
+		}
+
+		i := candidates[pick]
+		pending[k] = append(candidates[:pick:pick], candidates[pick+1:]...)
+		matched[i] = true
+
+		if !equalRows(a.Rows[i], r) {
+			d.Changed = append(d.Changed, RowChange{Old: a.Rows[i], New: r})
+		}
+	}
+
+	for i, r := range a.Rows {
+		if !matched[i] {
+			d.Removed = append(d.Removed, r)
+		}
+	}
+
+	return d
+}
+
+// keyColumns returns the positions of the key columns. All the columns are
+// used if there are no keys or any of them is missing.
+func keyColumns(columns, key []string) []int {
+	var positions []int
+	for _, k := range key {
+		found := false
+		for i, c := range columns {
+			if strings.EqualFold(c, k) {
+				positions = append(positions, i)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			positions = nil
+			break
+		}
+	}
+
+	if len(positions) == 0 {
+		positions = make([]int, len(columns))
+		for i := range columns {
+			positions[i] = i
+		}
+	}
+
+	return positions
+}
+
+func rowKey(row []sql.NullString, positions []int) string {
+	var b strings.Builder
+	for _, p := range positions {
+		if p >= len(row) || !row[p].Valid {
+			b.WriteString("\x00N")
+			continue
+		}
+
+		b.WriteString("\x00V")
+		b.WriteString(row[p].String)
+	}
+
+	return b.String()
+}
+
+func equalRows(a, b []sql.NullString) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func formatRow(row []sql.NullString) string {
+	values := make([]string, len(row))
+	for i, v := range row {
+		if v.Valid {
+			values[i] = v.String
+		} else {
+			values[i] = "NULL"
+		}
+	}
+
+	return strings.Join(values, "\t")
+}
+
+// writeDiff writes the differences in unified diff format. Changed rows are
+// shown as a removed line followed by an added line.
+func writeDiff(
+	w io.Writer,
+	versionA, versionB string,
+	query Query,
+	filter *Filter,
+	diffs []*TableDiff,
+) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	printf("# filter: %s\n", filter)
+	printf("--- %s\t%s\n", versionA, query.ID)
+	printf("+++ %s\t%s\n", versionB, query.ID)
+
+	for _, d := range diffs {
+		if d.Empty() {
+			continue
+		}
+
+		printf("@@ statement %d: -%d +%d ~%d @@\n",
+			d.Statement, len(d.Removed), len(d.Added), len(d.Changed))
+
+		if d.Truncated {
+			printf("# results truncated, differences may be incomplete\n")
+		}
+
+		colsA := strings.Join(d.ColumnsA, "\t")
+		colsB := strings.Join(d.ColumnsB, "\t")
+		if colsA != colsB {
+			printf("-%s\n+%s\n", colsA, colsB)
+		} else {
+			printf(" %s\n", colsA)
+		}
+
+		for _, r := range d.Removed {
+			printf("-%s\n", formatRow(r))
+		}
+		for _, r := range d.Added {
+			printf("+%s\n", formatRow(r))
+		}
+		for _, c := range d.Changed {
+			printf("-%s\n+%s\n", formatRow(c.Old), formatRow(c.New))
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,96 @@
+package gitbase
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func table(columns []string, rows ...[]string) *Table {
+	t := &Table{Columns: columns, Limit: len(rows)}
+	for _, r := range rows {
+		values := make([]sql.RawBytes, len(r))
+		for i, v := range r {
+			if v != "NULL" {
+				values[i] = sql.RawBytes(v)
+			}
+		}
+		t.add(values)
+	}
+
+	return t
+}
+
+func TestDiffTables(t *testing.T) {
+	require := require.New(t)
+
+	columns := []string{"id", "value"}
+	a := table(columns,
+		[]string{"1", "a"},
+		[]string{"2", "b"},
+		[]string{"3", "c"},
+	)
+	b := table(columns,
+		[]string{"3", "c"},
+		[]string{"2", "NULL"},
+		[]string{"4", "d"},
+	)
+
+	d := diffTables(a, b, []string{"id"})
+	require.Len(d.Removed, 1)
+	require.Equal("1\ta", formatRow(d.Removed[0]))
+	require.Len(d.Added, 1)
+	require.Equal("4\td", formatRow(d.Added[0]))
+	require.Len(d.Changed, 1)
+	require.Equal("2\tb", formatRow(d.Changed[0].Old))
+	require.Equal("2\tNULL", formatRow(d.Changed[0].New))
+
+	// without keys changed rows are shown as removed and added
+	d = diffTables(a, b, nil)
+	require.Len(d.Removed, 2)
+	require.Len(d.Added, 2)
+	require.Len(d.Changed, 0)
+
+	d = diffTables(a, a, []string{"id"})
+	require.True(d.Empty())
+}
+
+func TestWriteDiff(t *testing.T) {
+	require := require.New(t)
+
+	columns := []string{"id"}
+	a := []*Table{table(columns, []string{"1"}, []string{"2"})}
+	b := []*Table{table(columns, []string{"2"}, []string{"3"})}
+
+	var buf bytes.Buffer
+	err := writeDiff(&buf, "v1", "v2", Query{ID: "q"}, &Filter{}, diffOutputs(a, b, nil))
+	require.NoError(err)
+
+	expected := "# filter: all\n" +
+		"--- v1\tq\n" +
+		"+++ v2\tq\n" +
+		"@@ statement 1: -1 +1 ~0 @@\n" +
+		" id\n" +
+		"-1\n" +
+		"+3\n"
+	require.Equal(expected, buf.String())
+}
+
+func TestSameCapturesMessage(t *testing.T) {
+	require := require.New(t)
+
+	a := Checksum{Ordered: "a", Unordered: "x"}
+	require.Equal("", sameCapturesMessage(a, a, nil))
+
+	b := Checksum{Ordered: "b", Unordered: "x"}
+	require.Equal("rows returned in different order",
+		sameCapturesMessage(a, b, []*TableDiff{{Truncated: true}}))
+
+	b.Unordered = "y"
+	require.Equal("captured rows match, the difference is past the --diff-rows limit",
+		sameCapturesMessage(a, b, []*TableDiff{{}, {Truncated: true}}))
+	require.Equal("captured rows match but checksums differ",
+		sameCapturesMessage(a, b, []*TableDiff{{}}))
+}
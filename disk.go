@@ -0,0 +1,122 @@
+package gitbase
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// indexDepth is the number of directories under the index path that
+// identify an index: driver, database, table and index name.
+const indexDepth = 4
+
+// DiskUsage holds the space used by the index directory of a server.
+type DiskUsage struct {
+	Bytes int64
+	Files int64
+	// Indexes has the usage of each index by its path relative to the
+	// index directory. Files outside of an index directory are only
+	// counted in the totals.
+	Indexes map[string]*IndexUsage
+}
+
+// IndexUsage holds the space used by one index.
+type IndexUsage struct {
+	Bytes int64
+	Files int64
+}
+
+// indexNames returns the sorted paths of the indexes.
+func (d *DiskUsage) indexNames() []string {
+	names := make([]string, 0, len(d.Indexes))
+	for n := range d.Indexes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// readDiskUsage walks a server index directory.
+func readDiskUsage(path string) (*DiskUsage, error) {
+	usage := &DiskUsage{Indexes: make(map[string]*IndexUsage)}
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		usage.Bytes += info.Size()
+		usage.Files++
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) <= indexDepth {
+			return nil
+		}
+
+		name := strings.Join(parts[:indexDepth], "/")
+		index, ok := usage.Indexes[name]
+		if !ok {
+			index = new(IndexUsage)
+			usage.Indexes[name] = index
+		}
+
+		index.Bytes += info.Size()
+		index.Files++
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// averageDisk returns the mean disk usage of the results that measured it
+// or nil if none of them did.
+func averageDisk(rs []*Result) *DiskUsage {
+	avg := &DiskUsage{Indexes: make(map[string]*IndexUsage)}
+	var n int64
+	for _, r := range rs {
+		if r.Disk == nil {
+			continue
+		}
+
+		n++
+		avg.Bytes += r.Disk.Bytes
+		avg.Files += r.Disk.Files
+		for name, u := range r.Disk.Indexes {
+			index, ok := avg.Indexes[name]
+			if !ok {
+				index = new(IndexUsage)
+				avg.Indexes[name] = index
+			}
+
+			index.Bytes += u.Bytes
+			index.Files += u.Files
+		}
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	avg.Bytes /= n
+	avg.Files /= n
+	for _, u := range avg.Indexes {
+		u.Bytes /= n
+		u.Files /= n
+	}
+
+	return avg
+}
@@ -0,0 +1,63 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDiskUsage(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	index := filepath.Join(dir, "pilosa", "gitbase", "files", "files_path")
+	require.NoError(os.MkdirAll(filepath.Join(index, "data"), 0755))
+
+	files := map[string]int{
+		filepath.Join(index, "config.yml"):       10,
+		filepath.Join(index, "data", "fragment"): 20,
+		filepath.Join(dir, "pilosa", "registry"): 5,
+	}
+	for path, size := range files {
+		require.NoError(ioutil.WriteFile(path, make([]byte, size), 0644))
+	}
+
+	usage, err := readDiskUsage(dir)
+	require.NoError(err)
+	require.Equal(&DiskUsage{
+		Bytes: 35,
+		Files: 3,
+		Indexes: map[string]*IndexUsage{
+			"pilosa/gitbase/files/files_path": {Bytes: 30, Files: 2},
+		},
+	}, usage)
+}
+
+func TestAverageDisk(t *testing.T) {
+	require := require.New(t)
+
+	disk := func(bytes, files int64) *DiskUsage {
+		return &DiskUsage{
+			Bytes: bytes,
+			Files: files,
+			Indexes: map[string]*IndexUsage{
+				"a": {Bytes: bytes, Files: files},
+			},
+		}
+	}
+
+	rs := []*Result{
+		{Disk: disk(10, 2)},
+		{},
+		{Disk: disk(20, 4)},
+	}
+
+	require.Equal(disk(15, 3), averageDisk(rs))
+	require.Nil(averageDisk([]*Result{{}}))
+}
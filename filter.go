@@ -0,0 +1,105 @@
+package gitbase
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter selects the queries to run. Every criteria that is set must match
+// for a query to be selected, a query matches a list of IDs or tags if it
+// has any of them. Queries with any of the excluded tags are never run.
+type Filter struct {
+	IDs         []string
+	Regex       *regexp.Regexp
+	Tags        []string
+	ExcludeTags []string
+}
+
+// NewFilter creates a Filter from the test options.
+func NewFilter(o Options) (*Filter, error) {
+	f := &Filter{
+		IDs:         o.QueryIDs,
+		Tags:        o.Tags,
+		ExcludeTags: o.ExcludeTags,
+	}
+
+	if o.QueryRegex != "" {
+		r, err := regexp.Compile(o.QueryRegex)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Regex = r
+	}
+
+	return f, nil
+}
+
+// Match returns true if the query is selected.
+func (f *Filter) Match(q Query) bool {
+	if len(f.IDs) > 0 && !contains(f.IDs, q.ID) {
+		return false
+	}
+
+	if f.Regex != nil && !f.Regex.MatchString(q.ID) && !f.Regex.MatchString(q.Name) {
+		return false
+	}
+
+	if len(f.Tags) > 0 && !hasAny(q.Tags, f.Tags) {
+		return false
+	}
+
+	return !hasAny(q.Tags, f.ExcludeTags)
+}
+
+// Apply returns the selected queries.
+func (f *Filter) Apply(queries []Query) []Query {
+	var selected []Query
+	for _, q := range queries {
+		if f.Match(q) {
+			selected = append(selected, q)
+		}
+	}
+
+	return selected
+}
+
+// Active returns true when the filter can leave out queries.
+func (f *Filter) Active() bool {
+	return len(f.IDs) > 0 || f.Regex != nil ||
+		len(f.Tags) > 0 || len(f.ExcludeTags) > 0
+}
+
+// String returns a description of the filter used in reports.
+func (f *Filter) String() string {
+	var parts []string
+	if len(f.IDs) > 0 {
+		parts = append(parts, fmt.Sprintf("id=%s", strings.Join(f.IDs, ",")))
+	}
+	if f.Regex != nil {
+		parts = append(parts, fmt.Sprintf("regex=%s", f.Regex))
+	}
+	if len(f.Tags) > 0 {
+		parts = append(parts, fmt.Sprintf("tag=%s", strings.Join(f.Tags, ",")))
+	}
+	if len(f.ExcludeTags) > 0 {
+		parts = append(parts, fmt.Sprintf("exclude-tag=%s", strings.Join(f.ExcludeTags, ",")))
+	}
+
+	if len(parts) == 0 {
+		return "all"
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func hasAny(list, values []string) bool {
+	for _, v := range values {
+		if contains(list, v) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package gitbase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	require := require.New(t)
+
+	queries := []Query{
+		{ID: "commits-1", Name: "count commits", Tags: []string{"commits"}},
+		{ID: "commits-2", Name: "commit authors", Tags: []string{"commits", "slow"}},
+		{ID: "uast-1", Name: "parse files", Tags: []string{"uast"}},
+	}
+
+	ids := func(o Options) []string {
+		f, err := NewFilter(o)
+		require.NoError(err)
+
+		var ids []string
+		for _, q := range f.Apply(queries) {
+			ids = append(ids, q.ID)
+		}
+
+		return ids
+	}
+
+	require.Equal([]string{"commits-1", "commits-2", "uast-1"}, ids(Options{}))
+	require.Equal([]string{"uast-1"}, ids(Options{QueryIDs: []string{"uast-1"}}))
+	require.Equal([]string{"commits-2"}, ids(Options{QueryRegex: "authors$"}))
+	require.Equal([]string{"commits-1"}, ids(Options{
+		Tags:        []string{"commits"},
+		ExcludeTags: []string{"slow"},
+	}))
+	require.Nil(ids(Options{
+		QueryIDs: []string{"uast-1"},
+		Tags:     []string{"commits"},
+	}))
+
+	f, err := NewFilter(Options{Tags: []string{"a", "b"}, QueryRegex: "x"})
+	require.NoError(err)
+	require.Equal("regex=x tag=a,b", f.String())
+	require.True(f.Active())
+
+	f, err = NewFilter(Options{})
+	require.NoError(err)
+	require.Equal("all", f.String())
+	require.False(f.Active())
+
+	_, err = NewFilter(Options{QueryRegex: "("})
+	require.Error(err)
+}
@@ -1,31 +1,103 @@
 package gitbase
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-errors.v1"
 )
 
-// Server wraps a gitbase server instance.
+const (
+	defaultReadyTimeout = 2 * time.Minute
+	readyPollInterval   = 100 * time.Millisecond
+	serverHost          = "127.0.0.1"
+)
+
+// ErrNotReady is returned when the server does not accept connections
+// before the ready timeout.
+var ErrNotReady = errors.NewKind("gitbase server not ready after %s")
+
+// ErrServerExited is returned when the server exits before accepting
+// connections.
+var ErrServerExited = errors.NewKind("gitbase server exited before being ready: %s")
+
+// Server wraps a gitbase server instance. The process is managed directly
+// instead of using regression.Server so its pid is available to read its
+// resource counters while it runs.
 type Server struct {
-	*regression.Server
+	// ReadyTimeout is the maximum time to wait for the server to accept
+	// connections. Defaults to 2 minutes.
+	ReadyTimeout time.Duration
+	// StartupTime is the time the server took to accept connections.
+	StartupTime time.Duration
+	// StartupMemory is the resident memory in bytes of the server when it
+	// started accepting connections.
+	StartupMemory int64
+	// Disk is the usage of the index directory measured when the server
+	// was stopped. It is nil if it could not be read.
+	Disk *DiskUsage
+	// Args are extra arguments appended to the gitbase server command.
+	Args []string
+	// PprofFlag is the gitbase flag that enables the pprof endpoint. It
+	// is passed with the endpoint address as value. Disabled when empty.
+	PprofFlag string
+	// CPUs has the processors where the server is allowed to run. It can
+	// use any of them when empty.
+	CPUs []int
+	// Version is the gitbase version, used to choose the flags that serve
+	// the repositories. It is nil when unknown.
+	Version *semver.Version
+
+	port      int
+	pprofPort int
+	cmd       *exec.Cmd
+	done      chan struct{}
 	binary    string
-	repos     string
+	roots     []RepoRoot
 	indexPath string
 }
 
-// NewServer creates a new gitbase server struct.
-func NewServer(binary, repos string) *Server {
+// NewServer creates a new gitbase server struct serving the given
+// repository roots.
+func NewServer(binary string, roots ...RepoRoot) *Server {
 	return &Server{
-		Server: regression.NewServer(),
 		binary: binary,
-		repos:  repos,
+		roots:  roots,
 	}
 }
 
-// URL returns the mysql URL to connect to gitbase server.
+// URL returns the mysql URL to connect to gitbase server. The port is
+// assigned on Start.
 func (s *Server) URL() string {
-	return "root@tcp(localhost)/"
+	return fmt.Sprintf("root@tcp(%s:%d)/", serverHost, s.port)
+}
+
+// PprofURL returns the base URL of the pprof endpoint. It is only
+// available when PprofFlag is set.
+func (s *Server) PprofURL() string {
+	return fmt.Sprintf("http://%s:%d/debug/pprof", serverHost, s.pprofPort)
+}
+
+// Port returns the port where the server listens.
+func (s *Server) Port() int {
+	return s.port
+}
+
+// IndexPath returns the directory where the server saves its indexes. It
+// is removed on Stop.
+func (s *Server) IndexPath() string {
+	return s.indexPath
 }
 
 // Start spawns a new gitbase server.
@@ -37,28 +109,230 @@ func (s *Server) Start(envs map[string]string) error {
 
 	s.indexPath = tmpDir
 
-	return s.Server.Start(
-		s.binary,
-		envs,
-		"server",
-		"-g", s.repos,
+	port, err := reservePort()
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}
+	s.port = port
+
+	name := s.binary
+	args := []string{"server"}
+	args = append(args, rootArgs(s.roots, s.Version)...)
+	args = append(args,
 		"-i", tmpDir,
+		"--host", serverHost,
+		"--port", strconv.Itoa(port),
 	)
+	if s.PprofFlag != "" {
+		s.pprofPort, err = reservePort()
+		if err != nil {
+			_ = os.RemoveAll(tmpDir)
+			releasePort(port)
+			return err
+		}
+
+		addr := fmt.Sprintf("%s:%d", serverHost, s.pprofPort)
+		args = append(args, s.PprofFlag+"="+addr)
+	}
+	args = append(args, s.Args...)
+
+	if len(s.CPUs) > 0 {
+		args = append([]string{"-c", cpuList(s.CPUs), name}, args...)
+		name = "taskset"
+	}
+
+	s.cmd = exec.Command(name, args...)
+	s.cmd.Stdout = os.Stdout
+	s.cmd.Stderr = os.Stderr
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	s.cmd.Env = os.Environ()
+	for k, v := range envs {
+		s.cmd.Env = append(s.cmd.Env, k+"="+v)
+	}
+
+	start := time.Now()
+	err = s.cmd.Start()
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		releasePort(port)
+		releasePort(s.pprofPort)
+		return err
+	}
+
+	s.done = make(chan struct{})
+	go func() {
+		_ = s.cmd.Wait()
+		close(s.done)
+	}()
+
+	if err := s.waitReady(); err != nil {
+		_ = s.Stop()
+		return err
+	}
+
+	s.StartupTime = time.Since(start)
+	if status, err := readProcStatus(s.Pid()); err == nil {
+		s.StartupMemory = status["VmRSS"]
+	}
+
+	return nil
+}
+
+// waitReady polls the server until it accepts a mysql handshake, it exits
+// or the ready timeout is reached.
+func (s *Server) waitReady() error {
+	timeout := s.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	db, err := sql.Open("mysql", s.URL())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-s.done:
+			return ErrServerExited.New(s.cmd.ProcessState)
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			return ErrNotReady.Wrap(err, timeout)
+		}
+
+		time.Sleep(readyPollInterval)
+	}
 }
 
-// Stops stops the gitbase server and deletes the index directory.
+// Stops stops the gitbase server, measures the index directory usage and
+// deletes it. Stopping an already stopped server does nothing.
 func (s *Server) Stop() (err error) {
+	if s.done == nil || s.indexPath == "" {
+		return nil
+	}
+
 	defer func() {
+		if disk, derr := readDiskUsage(s.indexPath); derr == nil {
+			s.Disk = disk
+		}
+
 		rerr := os.RemoveAll(s.indexPath)
 		if err == nil {
 			err = rerr
 		}
+		s.indexPath = ""
+		releasePort(s.port)
+		releasePort(s.pprofPort)
 	}()
 
-	err = s.Server.Stop()
-	if err != nil {
+	if !s.Alive() {
+		return nil
+	}
+
+	err = syscall.Kill(-s.cmd.Process.Pid, syscall.SIGTERM)
+	if err != nil && err != syscall.ESRCH {
 		return err
 	}
+	err = nil
+
+	select {
+	case <-s.done:
+	case <-time.After(3 * time.Second):
+		_ = syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+		<-s.done
+	}
 
 	return
 }
+
+// Alive checks if the process is still running.
+func (s *Server) Alive() bool {
+	if s.done == nil {
+		return false
+	}
+
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Pid returns the process id of the server or 0 if it is not started.
+func (s *Server) Pid() int {
+	if s.cmd == nil || s.cmd.Process == nil {
+		return 0
+	}
+
+	return s.cmd.Process.Pid
+}
+
+// Rusage returns usage counters. It is only available after Stop.
+func (s *Server) Rusage() *syscall.Rusage {
+	if s.Alive() || s.cmd == nil || s.cmd.ProcessState == nil {
+		return new(syscall.Rusage)
+	}
+
+	rusage, _ := s.cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	return rusage
+}
+
+var (
+	portsMutex sync.Mutex
+	usedPorts  = make(map[int]bool)
+)
+
+// reservePort returns a free port not used by other servers of this
+// process.
+func reservePort() (int, error) {
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+
+	for {
+		l, err := net.Listen("tcp", serverHost+":0")
+		if err != nil {
+			return 0, err
+		}
+
+		port := l.Addr().(*net.TCPAddr).Port
+		if err := l.Close(); err != nil {
+			return 0, err
+		}
+
+		if !usedPorts[port] {
+			usedPorts[port] = true
+			return port, nil
+		}
+	}
+}
+
+func releasePort(port int) {
+	portsMutex.Lock()
+	delete(usedPorts, port)
+	portsMutex.Unlock()
+}
+
+// cpuList formats processors in the format used by taskset.
+func cpuList(cpus []int) string {
+	list := make([]string, len(cpus))
+	for i, c := range cpus {
+		list[i] = strconv.Itoa(c)
+	}
+
+	return strings.Join(list, ",")
+}
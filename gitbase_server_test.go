@@ -0,0 +1,214 @@
+package gitbase
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGitbase creates an executable that runs the given shell script
+// instead of gitbase.
+func fakeGitbase(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "gitbase")
+	err = ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	require.NoError(t, err)
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// fakeMySQL creates an executable that runs this test binary as a minimal
+// mysql server. It accepts any user, logs the statements received to the
+// file "queries" next to the executable, never answers statements
+// containing SLEEP, fails the ones containing ERROR and returns an empty
+// result to the rest.
+func fakeMySQL(t *testing.T) (string, func()) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	return fakeGitbase(t, fmt.Sprintf(
+		`REGRESSION_FAKE_MYSQL="$(dirname "$0")/queries" exec %q -test.run='^TestFakeMySQL$' -- "$@"`,
+		exe,
+	))
+}
+
+// TestFakeMySQL is the server run by the executables of fakeMySQL.
+func TestFakeMySQL(t *testing.T) {
+	queries := os.Getenv("REGRESSION_FAKE_MYSQL")
+	if queries == "" {
+		t.Skip("only run as fake mysql server")
+	}
+
+	var port string
+	args := os.Args
+	for i, a := range args {
+		if a == "--port" && i+1 < len(args) {
+			port = args[i+1]
+		}
+	}
+
+	l, err := net.Listen("tcp", serverHost+":"+port)
+	require.NoError(t, err)
+
+	w, err := os.Create(queries)
+	require.NoError(t, err)
+
+	for {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		go serveFakeMySQL(conn, w)
+	}
+}
+
+func serveFakeMySQL(conn net.Conn, queries io.Writer) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	write := func(seq byte, payload []byte) {
+		header := make([]byte, 4)
+		binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+		header[3] = seq
+		_, _ = conn.Write(append(header, payload...))
+	}
+
+	read := func() ([]byte, error) {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		header[3] = 0
+		payload := make([]byte, binary.LittleEndian.Uint32(header))
+		_, err := io.ReadFull(r, payload)
+		return payload, err
+	}
+
+	ok := []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+
+	// protocol 10 handshake with protocol 41, secure connection and
+	// plugin auth capabilities
+	handshake := []byte{0x0a}
+	handshake = append(handshake, "5.7.0-fake\x00"...)
+	handshake = append(handshake, 1, 0, 0, 0)
+	handshake = append(handshake, "abcdefgh\x00"...)
+	handshake = append(handshake, 0x01, 0xa2, 0x21, 0x02, 0x00, 0x08, 0x00, 21)
+	handshake = append(handshake, make([]byte, 10)...)
+	handshake = append(handshake, "ijklmnopqrst\x00"...)
+	handshake = append(handshake, "mysql_native_password\x00"...)
+	write(0, handshake)
+
+	if _, err := read(); err != nil {
+		return
+	}
+	write(2, ok)
+
+	for {
+		payload, err := read()
+		if err != nil || len(payload) == 0 {
+			return
+		}
+
+		switch payload[0] {
+		case 0x01: // quit
+			return
+		case 0x03: // query
+			query := string(payload[1:])
+			fmt.Fprintln(queries, query)
+
+			switch {
+			case strings.Contains(query, "SLEEP"):
+				// the connection is closed by the client
+			case strings.Contains(query, "ERROR"):
+				write(1, append([]byte{0xff, 0x48, 0x04, '#'}, "HY000fake error"...))
+			default:
+				write(1, ok)
+			}
+		default:
+			write(1, ok)
+		}
+	}
+}
+
+func TestServerExited(t *testing.T) {
+	require := require.New(t)
+
+	binary, clean := fakeGitbase(t, "exit 1")
+	defer clean()
+
+	server := NewServer(binary, RepoRoot{Path: "repos"})
+	err := server.Start(nil)
+	require.True(ErrServerExited.Is(err), "unexpected error: %v", err)
+	require.False(server.Alive())
+}
+
+func TestServerNotReady(t *testing.T) {
+	require := require.New(t)
+
+	binary, clean := fakeGitbase(t, "sleep 10")
+	defer clean()
+
+	server := NewServer(binary, RepoRoot{Path: "repos"})
+	server.ReadyTimeout = 300 * time.Millisecond
+	err := server.Start(nil)
+	require.True(ErrNotReady.Is(err), "unexpected error: %v", err)
+	require.False(server.Alive())
+}
+
+func TestServerPort(t *testing.T) {
+	require := require.New(t)
+
+	// the fake server writes its arguments and exits
+	binary, clean := fakeGitbase(t, `echo "$@" > "$(dirname "$0")/args"`)
+	defer clean()
+
+	server := NewServer(binary, RepoRoot{Path: "repos"})
+	err := server.Start(nil)
+	require.True(ErrServerExited.Is(err), "unexpected error: %v", err)
+
+	args, err := ioutil.ReadFile(filepath.Join(filepath.Dir(binary), "args"))
+	require.NoError(err)
+	require.Contains(string(args), fmt.Sprintf("--host 127.0.0.1 --port %d", server.Port()))
+	require.Equal(fmt.Sprintf("root@tcp(127.0.0.1:%d)/", server.Port()), server.URL())
+}
+
+func TestReservePort(t *testing.T) {
+	require := require.New(t)
+
+	a, err := reservePort()
+	require.NoError(err)
+	defer releasePort(a)
+
+	b, err := reservePort()
+	require.NoError(err)
+	defer releasePort(b)
+
+	require.NotEqual(a, b)
+}
+
+func TestServerArgs(t *testing.T) {
+	require := require.New(t)
+
+	binary, clean := fakeGitbase(t, `echo "$@" > "$(dirname "$0")/args"`)
+	defer clean()
+
+	server := NewServer(binary, RepoRoot{Path: "repos"})
+	server.Args = []string{"--readonly", "--parallelism", "2"}
+	err := server.Start(nil)
+	require.True(ErrServerExited.Is(err), "unexpected error: %v", err)
+
+	args, err := ioutil.ReadFile(filepath.Join(filepath.Dir(binary), "args"))
+	require.NoError(err)
+	require.Contains(string(args), "--readonly --parallelism 2\n")
+}
@@ -3,6 +3,7 @@ module github.com/src-d/regression-gitbase
 go 1.12
 
 require (
+	github.com/Masterminds/semver v1.5.0
 	github.com/bblfsh/sdk/v3 v3.2.3
 	github.com/go-sql-driver/mysql v1.4.0
 	github.com/google/go-cmp v0.3.1 // indirect
@@ -0,0 +1,416 @@
+package gitbase
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultIndexDriver = "pilosa"
+
+var regIndexID = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ErrInvalidIndex is returned when an index definition is not valid.
+var ErrInvalidIndex = errors.NewKind("index %s: %s")
+
+// Index describes an index built by the index suite and the queries used to
+// compare its performance.
+type Index struct {
+	// ID is used as the index name so it must be a valid identifier.
+	ID   string `yaml:"ID"`
+	Name string `yaml:"Name,omitempty"`
+	// Table is the table indexed.
+	Table string `yaml:"Table"`
+	// Expressions are the indexed columns or expressions.
+	Expressions []string `yaml:"Expressions"`
+	// Driver is the index driver, pilosa by default.
+	Driver string `yaml:"Driver,omitempty"`
+	// Queries are the statements run with and without the index.
+	Queries []string `yaml:"Queries"`
+	// Ordered marks queries where the order of the rows must be the same
+	// with and without the index.
+	Ordered bool `yaml:"Ordered,omitempty"`
+	// Timeout is the maximum time the index build and each run of the
+	// queries can take.
+	Timeout time.Duration `yaml:"Timeout,omitempty"`
+}
+
+func (i Index) validate() error {
+	if !regIndexID.MatchString(i.ID) {
+		return ErrInvalidIndex.New(i.ID, "ID must be a valid identifier")
+	}
+
+	if i.Table == "" {
+		return ErrInvalidIndex.New(i.ID, "no table")
+	}
+
+	if len(i.Expressions) == 0 {
+		return ErrInvalidIndex.New(i.ID, "no expressions")
+	}
+
+	if len(i.Queries) == 0 {
+		return ErrInvalidIndex.New(i.ID, "no queries")
+	}
+
+	return nil
+}
+
+func (i Index) driver() string {
+	if i.Driver == "" {
+		return defaultIndexDriver
+	}
+
+	return i.Driver
+}
+
+// createStatement returns the statement that builds the index. It waits
+// until the index is built so its time can be measured.
+func (i Index) createStatement() string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s USING %s (%s) WITH (async = false)",
+		i.ID, i.Table, i.driver(), strings.Join(i.Expressions, ", "))
+}
+
+// buildQuery returns the query that creates the index.
+func (i Index) buildQuery() Query {
+	return Query{
+		ID:         i.ID + "-build",
+		Name:       i.Name,
+		Statements: []string{i.createStatement()},
+		Timeout:    i.Timeout,
+	}
+}
+
+// query returns the query with the statements compared with and without
+// the index.
+func (i Index) query() Query {
+	return Query{
+		ID:         i.ID,
+		Name:       i.Name,
+		Statements: i.Queries,
+		Ordered:    i.Ordered,
+		Timeout:    i.Timeout,
+	}
+}
+
+func loadIndexesYaml(file string) ([]Index, error) {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []Index
+	err = yaml.Unmarshal(text, &indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range indexes {
+		if err := i.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return indexes, nil
+}
+
+// IndexResult holds the measures of one run of the index suite.
+type IndexResult struct {
+	Index  Index
+	Status Status
+	Error  string
+	// Plain is the run of the queries before building the index.
+	Plain *Result
+	// Build is the run of the index creation. Its memory is the peak
+	// memory used while building.
+	Build *Result
+	// Size is the number of bytes used by the index directory after the
+	// build.
+	Size int64
+	// Indexed is the run of the queries with the index built.
+	Indexed *Result
+}
+
+func (r *IndexResult) fail(status Status, err error) *IndexResult {
+	r.Status = status
+	r.Error = err.Error()
+	return r
+}
+
+// RunIndexes executes the index suite. For each version and index a new
+// server is started, the queries are run, the index is built and the
+// queries are run again.
+func (t *Test) RunIndexes() error {
+	indexes, err := loadIndexesYaml(t.options.Indexes)
+	if err != nil {
+		return err
+	}
+
+	t.indexes = indexes
+	t.indexResults = make(map[string]map[string][]*IndexResult)
+
+	times := t.config.Repeat
+	if times < 1 {
+		times = 1
+	}
+
+	for _, version := range t.config.Versions {
+		gitbase, ok := t.gitbase[version]
+		if !ok {
+			panic("gitbase not initialized. Was Prepare called?")
+		}
+
+		results := make(map[string][]*IndexResult)
+		t.indexResults[version] = results
+
+		for _, index := range indexes {
+			l := t.log.New(log.Fields{
+				"version":  version,
+				"index.ID": index.ID,
+			})
+
+			for i := 0; i < times; i++ {
+				l.Infof("Running index suite")
+
+				result := t.runIndex(gitbase, index)
+				results[index.ID] = append(results[index.ID], result)
+
+				if result.Status != StatusOK {
+					l.With(log.Fields{
+						"status": result.Status,
+					}).Errorf(fmt.Errorf("%s", result.Error), "Index suite failed")
+					break
+				}
+
+				l.With(log.Fields{
+					"build":  result.Build.Wtime,
+					"memory": result.Build.Memory,
+					"size":   result.Size,
+				}).Infof("Index built")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *Test) runIndex(gitbase *regression.Binary, index Index) *IndexResult {
+	result := &IndexResult{
+		Index:  index,
+		Status: StatusOK,
+	}
+
+	server, err := t.startServer(gitbase, t.testRepos)
+	if err != nil {
+		return result.fail(StatusError, err)
+	}
+	defer server.Stop()
+
+	run := func(query Query) (*Result, bool) {
+		r, err := t.runServerQuery(server, query, 0, true)
+		if err != nil {
+			result.fail(r.Status, err)
+			return r, false
+		}
+
+		return r, true
+	}
+
+	// the indexed queries run on a warm server, warm it up before the
+	// plain ones so caches do not inflate the speedup
+	var ok bool
+	for i := 0; i < t.options.Warmup || i < 1; i++ {
+		if _, ok = run(index.query()); !ok {
+			return result
+		}
+	}
+
+	if result.Plain, ok = run(index.query()); !ok {
+		return result
+	}
+
+	if result.Build, ok = run(index.buildQuery()); !ok {
+		return result
+	}
+
+	disk, err := readDiskUsage(server.IndexPath())
+	if err != nil {
+		return result.fail(StatusError, err)
+	}
+	result.Size = disk.Bytes
+
+	if result.Indexed, ok = run(index.query()); !ok {
+		return result
+	}
+
+	return result
+}
+
+// GetIndexResults prints the index suite results and returns if the tests
+// passed. Indexed queries must return the same rows as without the index
+// and build time, memory, size and indexed query time are compared between
+// versions.
+func (t *Test) GetIndexResults() bool {
+	if len(t.config.Versions) < 1 {
+		panic("there should be at least one version")
+	}
+
+	ok := true
+	for _, version := range t.config.Versions {
+		for _, index := range t.indexes {
+			if !indexCorrect(t.indexResults[version][index.ID], version) {
+				ok = false
+			}
+		}
+	}
+
+	versions := t.config.Versions
+	for i, version := range versions[0 : len(versions)-1] {
+		fmt.Printf("%s - %s ####\n", version, versions[i+1])
+		t.printArgs(versions[i], versions[i+1])
+		for _, index := range t.indexes {
+			a := t.indexResults[versions[i]][index.ID]
+			b := t.indexResults[versions[i+1]][index.ID]
+
+			fmt.Printf("## Index: %s (%s) ##\n", index.ID, index.Name)
+			if !compareIndexResults(a, b, t.options.allowance()) {
+				ok = false
+			}
+		}
+	}
+
+	return ok
+}
+
+// indexCorrect checks that the index does not change the query results.
+func indexCorrect(rs []*IndexResult, version string) bool {
+	ok := true
+	for _, r := range rs {
+		if r.Status != StatusOK {
+			continue
+		}
+
+		ordered := r.Index.Ordered
+		if !r.Plain.Checksum.Equal(r.Indexed.Checksum, ordered) {
+			fmt.Printf("# Failed - Index.ID: %s version: %s: "+
+				"results with index differ: %s -> %s\n",
+				r.Index.ID, version,
+				r.Plain.Checksum.Short(ordered), r.Indexed.Checksum.Short(ordered))
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// compareIndexResults prints the differences between the index suite runs
+// of two versions and returns if they are within allowance. The query
+// time without index is only informative.
+func compareIndexResults(a, b []*IndexResult, allowance float64) bool {
+	okA, okB := indexResultsOK(a), indexResultsOK(b)
+	if okA == nil || okB == nil {
+		fmt.Printf("# Skip - index suite failed in one of the versions\n")
+		return okB != nil
+	}
+
+	ok := true
+	compare := func(name string, x, y interface{}, change float64, fails bool) {
+		within := change <= allowance
+		if !within && fails {
+			ok = false
+		}
+
+		fmt.Printf(regression.CompareFormat, name, x, y, change, within)
+	}
+
+	plainA, plainB := average(indexRuns(okA, plainRun)), average(indexRuns(okB, plainRun))
+	buildA, buildB := average(indexRuns(okA, buildRun)), average(indexRuns(okB, buildRun))
+	indexedA, indexedB := average(indexRuns(okA, indexedRun)), average(indexRuns(okB, indexedRun))
+	sizeA, sizeB := averageSize(okA), averageSize(okB)
+
+	compare("Build", buildA.Wtime, buildB.Wtime,
+		percent(int64(buildA.Wtime), int64(buildB.Wtime)), true)
+	compare("BuildMemory", buildA.Memory, buildB.Memory,
+		percent(buildA.Memory, buildB.Memory), true)
+	compare("Size", sizeA, sizeB, percent(sizeA, sizeB), true)
+	compare("Plain", plainA.Wtime, plainB.Wtime,
+		percent(int64(plainA.Wtime), int64(plainB.Wtime)), false)
+	compare("Indexed", indexedA.Wtime, indexedB.Wtime,
+		percent(int64(indexedA.Wtime), int64(indexedB.Wtime)), true)
+
+	fmt.Printf("Speedup: %.2fx -> %.2fx\n",
+		speedup(plainA.Wtime, indexedA.Wtime),
+		speedup(plainB.Wtime, indexedB.Wtime))
+
+	ordered := okA[0].Index.Ordered
+	sumA, sumB := okA[0].Indexed.Checksum, okB[0].Indexed.Checksum
+	if !sumA.Equal(sumB, ordered) {
+		fmt.Printf("# Failed - results changed: %s -> %s\n",
+			sumA.Short(ordered), sumB.Short(ordered))
+		ok = false
+	}
+
+	return ok
+}
+
+// indexResultsOK returns the successful runs or nil if any of them failed.
+func indexResultsOK(rs []*IndexResult) []*IndexResult {
+	for _, r := range rs {
+		if r.Status != StatusOK {
+			fmt.Printf("# %s - Index.ID: %s: %s\n",
+				strings.Title(string(r.Status)), r.Index.ID, r.Error)
+			return nil
+		}
+	}
+
+	if len(rs) == 0 {
+		return nil
+	}
+
+	return rs
+}
+
+func plainRun(r *IndexResult) *Result   { return r.Plain }
+func buildRun(r *IndexResult) *Result   { return r.Build }
+func indexedRun(r *IndexResult) *Result { return r.Indexed }
+
+// indexRuns returns copies of one of the runs of each result so they can
+// be averaged without modifying them.
+func indexRuns(rs []*IndexResult, run func(*IndexResult) *Result) []*Result {
+	runs := make([]*Result, len(rs))
+	for i, r := range rs {
+		c := *run(r)
+		result := *c.Result
+		c.Result = &result
+		runs[i] = &c
+	}
+
+	return runs
+}
+
+func averageSize(rs []*IndexResult) int64 {
+	if len(rs) == 0 {
+		return 0
+	}
+
+	var total int64
+	for _, r := range rs {
+		total += r.Size
+	}
+
+	return total / int64(len(rs))
+}
+
+func speedup(plain, indexed time.Duration) float64 {
+	if indexed == 0 {
+		return 0
+	}
+
+	return float64(plain) / float64(indexed)
+}
@@ -0,0 +1,157 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadIndexes(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "indexes.yml")
+	err = ioutil.WriteFile(path, []byte(`
+- ID: files_path
+  Table: files
+  Expressions: [file_path]
+  Queries:
+    - SELECT COUNT(*) FROM files WHERE file_path = 'README.md'
+`), 0644)
+	require.NoError(err)
+
+	indexes, err := loadIndexesYaml(path)
+	require.NoError(err)
+	require.Len(indexes, 1)
+	require.Equal(
+		"CREATE INDEX files_path ON files USING pilosa (file_path) WITH (async = false)",
+		indexes[0].createStatement(),
+	)
+
+	err = ioutil.WriteFile(path, []byte(`
+- ID: files-path
+  Table: files
+  Expressions: [file_path]
+  Queries: [SELECT 1]
+`), 0644)
+	require.NoError(err)
+
+	_, err = loadIndexesYaml(path)
+	require.True(ErrInvalidIndex.Is(err))
+}
+
+func TestRunIndex(t *testing.T) {
+	require := require.New(t)
+
+	test, gitbase, clean := newFakeTest(t, Options{Warmup: 1})
+	defer clean()
+
+	index := Index{
+		ID:          "files_path",
+		Table:       "files",
+		Expressions: []string{"file_path"},
+		Queries:     []string{"SELECT 1"},
+	}
+
+	result := test.runIndex(gitbase, index)
+	require.Equal(StatusOK, result.Status, result.Error)
+	require.NotNil(result.Plain)
+	require.NotNil(result.Build)
+	require.NotNil(result.Indexed)
+
+	// warm-up, plain run, build and indexed run
+	queries, err := ioutil.ReadFile(filepath.Join(filepath.Dir(gitbase.Path), "queries"))
+	require.NoError(err)
+	require.Equal([]string{
+		"SELECT 1",
+		"SELECT 1",
+		index.createStatement(),
+		"SELECT 1",
+	}, strings.Split(strings.TrimSpace(string(queries)), "\n"))
+
+	// a failed build stops the suite
+	index.Table = "ERROR"
+	result = test.runIndex(gitbase, index)
+	require.Equal(StatusError, result.Status)
+	require.Contains(result.Error, "fake error")
+	require.Nil(result.Indexed)
+}
+
+func TestIndexCorrect(t *testing.T) {
+	require := require.New(t)
+
+	run := func(sum string) *Result {
+		r := NewResult()
+		r.Checksum = Checksum{Ordered: sum, Unordered: sum}
+		return r
+	}
+
+	index := Index{ID: "files_path"}
+	rs := []*IndexResult{
+		{Index: index, Status: StatusOK, Plain: run("a"), Indexed: run("a")},
+		{Index: index, Status: StatusError},
+	}
+	require.True(indexCorrect(rs, "v1"))
+
+	rs = append(rs, &IndexResult{
+		Index:   index,
+		Status:  StatusOK,
+		Plain:   run("a"),
+		Indexed: run("b"),
+	})
+	require.False(indexCorrect(rs, "v1"))
+}
+
+func TestCompareIndexResults(t *testing.T) {
+	require := require.New(t)
+
+	index := Index{ID: "files_path"}
+	result := func(plain, build time.Duration, size int64) *IndexResult {
+		run := func(wall time.Duration) *Result {
+			r := NewResult()
+			r.Wtime = wall
+			r.Memory = 1024
+			r.Checksum = Checksum{Ordered: "a", Unordered: "a"}
+			return r
+		}
+
+		return &IndexResult{
+			Index:   index,
+			Status:  StatusOK,
+			Plain:   run(plain),
+			Build:   run(build),
+			Size:    size,
+			Indexed: run(10 * time.Millisecond),
+		}
+	}
+
+	base := []*IndexResult{result(time.Second, time.Second, 100)}
+	require.True(compareIndexResults(base, base, 10))
+
+	// the query time without index is informative
+	slowPlain := []*IndexResult{result(2*time.Second, time.Second, 100)}
+	require.True(compareIndexResults(base, slowPlain, 10))
+
+	slowBuild := []*IndexResult{result(time.Second, 2*time.Second, 100)}
+	require.False(compareIndexResults(base, slowBuild, 10))
+
+	bigger := []*IndexResult{result(time.Second, time.Second, 200)}
+	require.False(compareIndexResults(base, bigger, 10))
+
+	changed := []*IndexResult{result(time.Second, time.Second, 100)}
+	changed[0].Indexed.Checksum = Checksum{Ordered: "b", Unordered: "b"}
+	require.False(compareIndexResults(base, changed, 10))
+
+	// only a failure of the new version fails
+	failed := []*IndexResult{{Index: index, Status: StatusError, Error: "failed"}}
+	require.True(compareIndexResults(failed, base, 10))
+	require.False(compareIndexResults(base, failed, 10))
+}
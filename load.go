@@ -0,0 +1,483 @@
+package gitbase
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// LoadResult holds the outcome of a concurrent load run of a version.
+type LoadResult struct {
+	Clients int
+	// Duration is the time since the first query started until the last
+	// one finished.
+	Duration time.Duration
+	// Queries is the number of queries run, including failed ones.
+	Queries int64
+	// Errors is the number of failed queries.
+	Errors int64
+	// QPS is the number of successful queries per second.
+	QPS float64
+	// P50, P95 and P99 are latency percentiles of successful queries.
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	// Mix has the queries chosen by the clients.
+	Mix []Query
+	// PerQuery has the results of each query by ID.
+	PerQuery map[string]*QueryLoad
+}
+
+// QueryLoad holds the outcome of one query in a concurrent load run.
+type QueryLoad struct {
+	// Runs is the number of times the query was run, including failures.
+	Runs   int64
+	Errors int64
+	// P50, P95 and P99 are latency percentiles of the successful runs.
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// Successes returns the number of successful queries.
+func (r *LoadResult) Successes() int64 {
+	return r.Queries - r.Errors
+}
+
+// ErrorRate returns the percentage of failed queries.
+func (r *LoadResult) ErrorRate() float64 {
+	if r.Queries == 0 {
+		return 0
+	}
+
+	return float64(r.Errors) / float64(r.Queries) * 100
+}
+
+// ComparePrint shows the difference between two load results and returns
+// if it is within allowance. Lower QPS and higher latencies or error rate
+// are regressions. The overall QPS and latencies use the limits of the
+// query mix of the second result, see mixLimits, and the latencies of each
+// query use its wall time allowance and fail setting.
+func (r *LoadResult) ComparePrint(q *LoadResult, allowance float64) bool {
+	ok := true
+	mixAllowance, mixFails := mixLimits(q.Mix, allowance)
+	compareWith := func(name string, a, b interface{}, change, limit float64, fails bool) {
+		within := change <= limit
+		if !within && fails {
+			ok = false
+		}
+
+		fmt.Printf(regression.CompareFormat, name, a, b, change, within)
+	}
+
+	compare := func(name string, a, b interface{}, change float64) {
+		compareWith(name, a, b, change, mixAllowance, mixFails)
+	}
+
+	// QPS decreasing is a regression so the change is inverted. Without
+	// successful queries in the reference any QPS is an improvement.
+	var qps float64
+	switch {
+	case r.QPS == q.QPS:
+		qps = 0
+	case r.QPS == 0:
+		qps = -100
+	default:
+		qps = (r.QPS - q.QPS) / r.QPS * 100
+	}
+	compare("QPS", r.QPS, q.QPS, qps)
+
+	// latencies are only measured in successful queries, a version
+	// without them has nothing to compare and fails by its error rate
+	latency := func(name string, a, b time.Duration) {
+		if r.Successes() == 0 || q.Successes() == 0 {
+			fmt.Printf("%s: %v -> %v (n/a)\n", name, a, b)
+			return
+		}
+
+		compare(name, a, b, percent(int64(a), int64(b)))
+	}
+	latency("P50", r.P50, q.P50)
+	latency("P95", r.P95, q.P95)
+	latency("P99", r.P99, q.P99)
+
+	// any increase of the error rate is a regression
+	errors := q.ErrorRate() - r.ErrorRate()
+	errorsOK := errors <= 0
+	if !errorsOK {
+		ok = false
+	}
+	fmt.Printf(regression.CompareFormat,
+		"Errors", r.ErrorRate(), q.ErrorRate(), errors, errorsOK)
+
+	for _, query := range q.Mix {
+		a, foundA := r.PerQuery[query.ID]
+		b, foundB := q.PerQuery[query.ID]
+		if !foundA || !foundB {
+			fmt.Printf("# Skip - Query.ID: %s not run in one of the versions\n", query.ID)
+			continue
+		}
+
+		fmt.Printf("## Query {ID: %s, Name: %s} runs: %d -> %d, errors: %d -> %d ##\n",
+			query.ID, query.Name, a.Runs, b.Runs, a.Errors, b.Errors)
+
+		if a.Runs == a.Errors || b.Runs == b.Errors {
+			fmt.Printf("Latency: n/a, no successful runs\n")
+			continue
+		}
+
+		limit := query.allowance(MetricWall, allowance)
+		fails := query.fails(MetricWall)
+		for _, p := range []struct {
+			name string
+			a, b time.Duration
+		}{
+			{"P50", a.P50, b.P50},
+			{"P95", a.P95, b.P95},
+			{"P99", a.P99, b.P99},
+		} {
+			compareWith(p.name, p.a, p.b, percent(int64(p.a), int64(p.b)), limit, fails)
+		}
+	}
+
+	return ok
+}
+
+// mixLimits returns the allowance and fail setting of the overall metrics
+// of a concurrent load run. The allowance is the mean of the wall time
+// allowances of the queries weighted by their frequency and the metrics
+// fail if any of the queries fails by wall time. Without queries the
+// default allowance is used and the metrics fail.
+func mixLimits(mix []Query, allowance float64) (float64, bool) {
+	if len(mix) == 0 {
+		return allowance, true
+	}
+
+	var (
+		total, weights float64
+		fails          bool
+	)
+	for _, q := range mix {
+		w := float64(q.weight())
+		total += w * q.allowance(MetricWall, allowance)
+		weights += w
+		if q.fails(MetricWall) {
+			fails = true
+		}
+	}
+
+	return total / weights, fails
+}
+
+// RunConcurrent executes the concurrent load mode. For each version a
+// server is started and several clients run queries from the catalog at
+// the same time, chosen randomly using their weights.
+func (t *Test) RunConcurrent() error {
+	t.loadResults = make(map[string]*LoadResult)
+
+	for _, version := range t.config.Versions {
+		l := t.log.New(log.Fields{"version": version})
+		l.Infof("Running version concurrent load")
+
+		queries, err := t.loadQueries(version)
+		if err != nil {
+			return err
+		}
+
+		var applicable []Query
+		for _, q := range queries {
+			if q.applies(t.semvers[version], t.builds[version]) {
+				applicable = append(applicable, q)
+			}
+		}
+
+		if len(applicable) == 0 {
+			l.Warningf("No queries to run")
+			continue
+		}
+
+		server, err := t.startServer(t.gitbase[version], t.testRepos)
+		if err != nil {
+			return err
+		}
+
+		result := t.runClients(server, applicable)
+		server.Stop()
+
+		l.With(log.Fields{
+			"queries": result.Queries,
+			"errors":  result.Errors,
+			"qps":     result.QPS,
+		}).Infof("Finished concurrent load")
+
+		t.loadResults[version] = result
+	}
+
+	return nil
+}
+
+// GetConcurrentResults prints the concurrent load results and returns if
+// the tests passed.
+func (t *Test) GetConcurrentResults() bool {
+	if len(t.config.Versions) < 1 {
+		panic("there should be at least one version")
+	}
+
+	fmt.Printf("Filter: %s\n", t.filter)
+
+	versions := t.config.Versions
+	ok := true
+	for i, version := range versions[0 : len(versions)-1] {
+		fmt.Printf("%s - %s ####\n", version, versions[i+1])
+		t.printArgs(versions[i], versions[i+1])
+		a, foundA := t.loadResults[versions[i]]
+		b, foundB := t.loadResults[versions[i+1]]
+		if !foundA || !foundB {
+			fmt.Printf("# Skip - no load results for one of the versions\n")
+			continue
+		}
+
+		fmt.Printf("## Clients: %d, Queries: %d -> %d ##\n", b.Clients, a.Queries, b.Queries)
+		if !a.ComparePrint(b, t.options.allowance()) {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+const (
+	// minConnectBackoff and maxConnectBackoff limit the wait between
+	// connection attempts of a load client.
+	minConnectBackoff = 50 * time.Millisecond
+	maxConnectBackoff = 2 * time.Second
+)
+
+type loadSample struct {
+	query   string
+	latency time.Duration
+	err     error
+}
+
+// runClients runs the concurrent clients against a server and aggregates
+// their samples.
+func (t *Test) runClients(server *Server, queries []Query) *LoadResult {
+	clients := t.options.Clients
+	samples := make([][]loadSample, clients)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			samples[i] = t.runClient(server, queries, int64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	return aggregateLoad(clients, time.Since(start), queries, samples)
+}
+
+// aggregateLoad builds the result of a concurrent load run from the
+// samples of its clients.
+func aggregateLoad(
+	clients int,
+	duration time.Duration,
+	queries []Query,
+	samples [][]loadSample,
+) *LoadResult {
+	result := &LoadResult{
+		Clients:  clients,
+		Duration: duration,
+		Mix:      queries,
+		PerQuery: make(map[string]*QueryLoad),
+	}
+
+	var latencies []time.Duration
+	perQuery := make(map[string][]time.Duration)
+	for _, s := range samples {
+		for _, sample := range s {
+			result.Queries++
+
+			// connection errors do not belong to any query
+			var ql *QueryLoad
+			if sample.query != "" {
+				ql = result.PerQuery[sample.query]
+				if ql == nil {
+					ql = new(QueryLoad)
+					result.PerQuery[sample.query] = ql
+				}
+				ql.Runs++
+			}
+
+			if sample.err != nil {
+				result.Errors++
+				if ql != nil {
+					ql.Errors++
+				}
+				continue
+			}
+
+			latencies = append(latencies, sample.latency)
+			if ql != nil {
+				perQuery[sample.query] = append(perQuery[sample.query], sample.latency)
+			}
+		}
+	}
+
+	sortDurations(latencies)
+	result.QPS = float64(len(latencies)) / duration.Seconds()
+	result.P50 = percentile(latencies, 50)
+	result.P95 = percentile(latencies, 95)
+	result.P99 = percentile(latencies, 99)
+
+	for id, l := range perQuery {
+		sortDurations(l)
+		ql := result.PerQuery[id]
+		ql.P50 = percentile(l, 50)
+		ql.P95 = percentile(l, 95)
+		ql.P99 = percentile(l, 99)
+	}
+
+	return result
+}
+
+func sortDurations(d []time.Duration) {
+	sort.Slice(d, func(i, j int) bool {
+		return d[i] < d[j]
+	})
+}
+
+// runClient runs queries in one connection until the configured number of
+// iterations or the load duration is reached. Only the statements are
+// measured, setup and teardown are run for each query.
+func (t *Test) runClient(server *Server, queries []Query, seed int64) []loadSample {
+	random := rand.New(rand.NewSource(time.Now().UnixNano() + seed))
+	client := NewSQLTest(server.URL(), Query{})
+	connected := false
+
+	var (
+		samples []loadSample
+		backoff time.Duration
+	)
+	start := time.Now()
+	for i := 0; t.continueLoad(i, start); i++ {
+		if !connected {
+			if err := client.Connect(); err != nil {
+				samples = append(samples, loadSample{err: err})
+
+				// wait before retrying so a server that does not
+				// accept connections does not flood the samples
+				backoff = connectBackoff(backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			connected = true
+			backoff = 0
+		}
+
+		query := pickQuery(random, queries)
+		client.Query = query
+		timeout := t.timeout(query)
+
+		ctx, cancel := withTimeout(timeout)
+		err := client.Setup(ctx)
+		cancel()
+		if err != nil {
+			samples = append(samples, loadSample{query: query.ID, err: err})
+
+			// the session may be broken, use a new one
+			client.Disconnect()
+			connected = false
+			continue
+		}
+
+		// a timed out query is an error, the server is not killed as
+		// other clients are using it
+		ctx, cancel = withTimeout(timeout)
+		queryStart := time.Now()
+		_, err = client.ExecuteCtx(ctx)
+		latency := time.Since(queryStart)
+		cancel()
+
+		samples = append(samples, loadSample{query: query.ID, latency: latency, err: err})
+
+		ctx, cancel = withTimeout(timeout)
+		terr := client.Teardown(ctx)
+		cancel()
+
+		// the session may be broken after an error, use a new one
+		if err != nil || terr != nil {
+			client.Disconnect()
+			connected = false
+		}
+	}
+
+	if connected {
+		client.Disconnect()
+	}
+
+	return samples
+}
+
+// connectBackoff returns the wait before the next connection attempt,
+// doubling the previous one up to maxConnectBackoff.
+func connectBackoff(previous time.Duration) time.Duration {
+	next := 2 * previous
+	switch {
+	case next < minConnectBackoff:
+		return minConnectBackoff
+	case next > maxConnectBackoff:
+		return maxConnectBackoff
+	default:
+		return next
+	}
+}
+
+func (t *Test) continueLoad(iteration int, start time.Time) bool {
+	if t.options.LoadIterations > 0 {
+		return iteration < t.options.LoadIterations
+	}
+
+	return time.Since(start) < t.options.loadDuration()
+}
+
+// pickQuery chooses a random query using their weights.
+func pickQuery(random *rand.Rand, queries []Query) Query {
+	var total int
+	for _, q := range queries {
+		total += q.weight()
+	}
+
+	n := random.Intn(total)
+	for _, q := range queries {
+		n -= q.weight()
+		if n < 0 {
+			return q
+		}
+	}
+
+	return queries[len(queries)-1]
+}
+
+// percentile returns the p percentile of sorted durations using the
+// nearest rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
@@ -0,0 +1,166 @@
+package gitbase
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	require := require.New(t)
+
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	require.Equal(50*time.Millisecond, percentile(sorted, 50))
+	require.Equal(95*time.Millisecond, percentile(sorted, 95))
+	require.Equal(100*time.Millisecond, percentile(sorted, 100))
+	require.Equal(time.Duration(0), percentile(nil, 50))
+}
+
+func TestPickQuery(t *testing.T) {
+	require := require.New(t)
+
+	queries := []Query{
+		{ID: "a", Weight: 3},
+		{ID: "b"},
+	}
+
+	random := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[pickQuery(random, queries).ID]++
+	}
+
+	require.InDelta(3000, counts["a"], 200)
+	require.InDelta(1000, counts["b"], 200)
+}
+
+func TestLoadResultComparePrint(t *testing.T) {
+	require := require.New(t)
+
+	a := &LoadResult{Queries: 100, QPS: 100, P50: 10 * time.Millisecond}
+	b := &LoadResult{Queries: 100, QPS: 95, P50: 10 * time.Millisecond}
+	require.True(a.ComparePrint(b, 10))
+
+	b.QPS = 80
+	require.False(a.ComparePrint(b, 10))
+
+	b.QPS = 100
+	b.Errors = 1
+	require.False(a.ComparePrint(b, 10))
+
+	// a reference without successful queries
+	a = &LoadResult{Queries: 100, Errors: 100}
+	b = &LoadResult{
+		Queries: 100,
+		QPS:     10,
+		P50:     10 * time.Millisecond,
+		P95:     20 * time.Millisecond,
+		P99:     30 * time.Millisecond,
+	}
+	require.True(a.ComparePrint(b, 10))
+	require.False(b.ComparePrint(a, 10))
+}
+
+func TestConnectBackoff(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(minConnectBackoff, connectBackoff(0))
+	require.Equal(2*minConnectBackoff, connectBackoff(minConnectBackoff))
+	require.Equal(maxConnectBackoff, connectBackoff(maxConnectBackoff))
+}
+
+func TestMixLimits(t *testing.T) {
+	require := require.New(t)
+
+	allowance, fails := mixLimits(nil, 10)
+	require.Equal(10.0, allowance)
+	require.True(fails)
+
+	mix := []Query{
+		{ID: "a", Weight: 3, Allowance: map[string]float64{MetricWall: 50}},
+		{ID: "b", Fail: []string{MetricMemory}},
+	}
+	allowance, fails = mixLimits(mix, 10)
+	require.Equal(40.0, allowance)
+	require.True(fails)
+
+	allowance, fails = mixLimits(mix[1:], 10)
+	require.Equal(10.0, allowance)
+	require.False(fails)
+}
+
+func TestAggregateLoad(t *testing.T) {
+	require := require.New(t)
+
+	queries := []Query{{ID: "a"}, {ID: "b"}}
+	samples := [][]loadSample{
+		{
+			{query: "a", latency: 10 * time.Millisecond},
+			{query: "b", latency: 30 * time.Millisecond},
+			{err: errors.New("connection refused")},
+		},
+		{
+			{query: "a", latency: 20 * time.Millisecond},
+			{query: "b", err: errors.New("failed")},
+		},
+	}
+
+	r := aggregateLoad(2, time.Second, queries, samples)
+	require.Equal(int64(5), r.Queries)
+	require.Equal(int64(2), r.Errors)
+	require.Equal(3.0, r.QPS)
+	require.Equal(20*time.Millisecond, r.P50)
+	require.Equal(queries, r.Mix)
+	require.Equal(&QueryLoad{
+		Runs: 2,
+		P50:  10 * time.Millisecond,
+		P95:  20 * time.Millisecond,
+		P99:  20 * time.Millisecond,
+	}, r.PerQuery["a"])
+	require.Equal(&QueryLoad{
+		Runs:   2,
+		Errors: 1,
+		P50:    30 * time.Millisecond,
+		P95:    30 * time.Millisecond,
+		P99:    30 * time.Millisecond,
+	}, r.PerQuery["b"])
+}
+
+func TestLoadResultComparePrintQueries(t *testing.T) {
+	require := require.New(t)
+
+	result := func(mix []Query, a, b time.Duration) *LoadResult {
+		return &LoadResult{
+			Queries: 100,
+			QPS:     100,
+			P50:     a,
+			Mix:     mix,
+			PerQuery: map[string]*QueryLoad{
+				"a": {Runs: 50, P50: a, P95: a, P99: a},
+				"b": {Runs: 50, P50: b, P95: b, P99: b},
+			},
+		}
+	}
+
+	mix := []Query{{ID: "a"}, {ID: "b"}}
+	base := result(mix, 10*time.Millisecond, 10*time.Millisecond)
+
+	// a slower query fails with the default allowance
+	require.False(base.ComparePrint(result(mix, 10*time.Millisecond, 13*time.Millisecond), 10))
+
+	// or passes with its own allowance
+	mix[1].Allowance = map[string]float64{MetricWall: 50}
+	require.True(base.ComparePrint(result(mix, 10*time.Millisecond, 13*time.Millisecond), 10))
+
+	// or when its wall time does not fail
+	mix[1] = Query{ID: "b", Fail: []string{MetricMemory}}
+	require.True(base.ComparePrint(result(mix, 10*time.Millisecond, 20*time.Millisecond), 10))
+	require.False(base.ComparePrint(result(mix, 20*time.Millisecond, 10*time.Millisecond), 10))
+}
@@ -0,0 +1,161 @@
+package gitbase
+
+import "time"
+
+const (
+	defaultDiffRows     = 1000
+	defaultAllowance    = 10.0
+	defaultLoadDuration = time.Minute
+	defaultProfileTop   = 10
+	defaultProfileDir   = "profiles"
+)
+
+// Options holds the gitbase specific configuration of a Test.
+type Options struct {
+	// Allowance is the default maximum percentage of change allowed
+	// between versions for queries that do not set their own.
+	Allowance float64 `long:"allowance" default:"10" description:"default percentage of change allowed between versions"`
+	// Significance enables the statistical comparison of the runs with
+	// this significance level. Changes over the allowance are only
+	// regressions when they are significant. Averages are compared when
+	// it is 0.
+	Significance float64 `long:"significance" description:"compare runs statistically with this significance level, for example 0.05"`
+	// StatsTest is the test used to decide if a change is significant.
+	StatsTest string `long:"stats-test" default:"bootstrap" choice:"bootstrap" choice:"mann-whitney" description:"statistical test used with --significance"`
+	// ReadyTimeout is the maximum time to wait for a gitbase server to
+	// accept connections. Versions whose server is not ready are not
+	// started again and their remaining queries fail.
+	ReadyTimeout time.Duration `long:"ready-timeout" default:"2m" description:"maximum time to wait for gitbase to accept connections"`
+	// ReposFormat is the format of the repositories served by gitbase,
+	// plain git repositories or siva files.
+	ReposFormat string `long:"repos-format" default:"plain" choice:"plain" choice:"siva" description:"format of the repositories served by gitbase"`
+	// ReposSplit distributes the test repositories in this number of
+	// roots, all of them served by each gitbase server.
+	ReposSplit int `long:"repos-split" description:"distribute the test repositories in this number of repository roots"`
+	// ReposRoots are extra repository roots served with the test
+	// repositories, in the format [plain:|siva:]path.
+	ReposRoots []string `long:"repos-root" description:"extra repository root served by gitbase as [plain:|siva:]path, can be repeated"`
+	// GitbaseArgs are extra arguments for all the gitbase servers.
+	GitbaseArgs []string `long:"gitbase-arg" description:"extra argument for gitbase server, can be repeated"`
+	// GitbaseArgsFile is a YAML file mapping versions to extra gitbase
+	// server arguments. They are added after GitbaseArgs.
+	GitbaseArgsFile string `long:"gitbase-args" description:"YAML file with extra gitbase server arguments per version"`
+	// Queries has files or directories with queries added to the ones
+	// from gitbase. Queries with the same ID replace the previous ones.
+	Queries []string `long:"queries" description:"file or directory with extra queries, can be repeated"`
+	// ReplaceQueries uses only the queries from Queries.
+	ReplaceQueries bool `long:"replace-queries" description:"do not use gitbase queries, only the ones from --queries"`
+	// QueryIDs selects the queries to run by ID.
+	QueryIDs []string `long:"query" description:"run only the query with this ID, can be repeated"`
+	// QueryRegex selects the queries with ID or name matching it.
+	QueryRegex string `long:"query-regex" description:"run only queries with ID or name matching the regular expression"`
+	// Tags selects the queries with any of the tags.
+	Tags []string `long:"tag" description:"run only queries with this tag, can be repeated"`
+	// ExcludeTags skips the queries with any of the tags.
+	ExcludeTags []string `long:"exclude-tag" description:"do not run queries with this tag, can be repeated"`
+	// Timeout is the maximum time a query can run when it does not have
+	// its own timeout. There is no limit when it is 0.
+	Timeout time.Duration `long:"timeout" description:"default query timeout, 0 disables it"`
+	// Warm reuses the same gitbase server for all the runs of a version.
+	// Resources are measured from the server counters during each query.
+	Warm bool `long:"warm" description:"reuse one gitbase server per version for all the queries"`
+	// Warmup is the number of runs of each query discarded before
+	// measuring it. Each warm-up run is added to the --repeat measured
+	// ones.
+	Warmup int `long:"warmup" default:"1" description:"number of discarded runs of each query before the measured ones, run in addition to --repeat"`
+	// Outliers is the method used to discard outlier runs by their wall
+	// time before aggregating them.
+	Outliers string `long:"outliers" default:"none" choice:"none" choice:"iqr" choice:"mad" description:"method to discard outlier runs"`
+	// Adaptive keeps repeating each query after the configured repetitions
+	// until its wall time is stable.
+	Adaptive bool `long:"adaptive" description:"repeat each query until the confidence interval of its wall time is narrower than --adaptive-width"`
+	// AdaptiveWidth is the maximum width of the 95% confidence interval of
+	// the median wall time, as a percentage of the median.
+	AdaptiveWidth float64 `long:"adaptive-width" default:"5" description:"maximum width of the wall time confidence interval in percentage of the median"`
+	// AdaptiveMax is the maximum number of repetitions of a query in
+	// adaptive mode.
+	AdaptiveMax int `long:"adaptive-max" default:"30" description:"maximum number of repetitions of each query in adaptive mode"`
+	// AdaptiveTime is the maximum time spent repeating a query for a
+	// version in adaptive mode. 0 disables the limit.
+	AdaptiveTime time.Duration `long:"adaptive-time" default:"10m" description:"maximum time repeating each query per version in adaptive mode, 0 disables it"`
+	// SampleInterval is the interval between samples of the server
+	// resource counters while the statements run. Sampling is disabled
+	// when it is 0.
+	SampleInterval time.Duration `long:"sample-interval" description:"interval to sample server resources while queries run, 0 disables it"`
+	// Parallel runs all the versions at the same time, each one pinned to
+	// a disjoint set of processors.
+	Parallel bool `long:"parallel" description:"run the versions at the same time pinned to different processors"`
+	// Clients enables the concurrent load mode with this number of
+	// clients running queries at the same time.
+	Clients int `long:"clients" description:"run the concurrent load mode with this number of clients"`
+	// LoadDuration is the duration of the concurrent load run of each
+	// version.
+	LoadDuration time.Duration `long:"load-duration" default:"1m" description:"duration of the concurrent load run"`
+	// LoadIterations is the number of queries run by each client. It
+	// overrides LoadDuration.
+	LoadIterations int `long:"load-iterations" description:"number of queries run by each client in concurrent load mode, overrides the duration"`
+	// Indexes is a file with the indexes built by the index suite. The
+	// suite is run instead of the queries when it is set.
+	Indexes string `long:"indexes" description:"run the index suite with the indexes defined in this file"`
+	// Diff enables saving the rows returned by each query to show the
+	// differences between versions.
+	Diff bool `long:"diff" description:"show row differences between versions"`
+	// DiffRows is the maximum number of rows saved per statement.
+	DiffRows int `long:"diff-rows" default:"1000" description:"maximum number of rows per statement used in diffs"`
+	// DiffDir is the directory where diff files are saved.
+	DiffDir string `long:"diff-dir" description:"directory to save diff files"`
+	// Profile enables capturing cpu and heap profiles of each query.
+	Profile bool `long:"profile" description:"capture cpu and heap profiles of each query"`
+	// ProfileFlag is the gitbase flag that enables its pprof endpoint.
+	// gitbase releases do not have a common one, it must be set for the
+	// binaries tested.
+	ProfileFlag string `long:"profile-flag" description:"gitbase flag that enables the pprof endpoint, the address is passed as its value, required with --profile"`
+	// ProfileDir is the directory where profiles are saved.
+	ProfileDir string `long:"profile-dir" default:"profiles" description:"directory to save profiles"`
+	// ProfileTop is the number of functions shown in profile diffs.
+	ProfileTop int `long:"profile-top" default:"10" description:"number of functions shown in profile diffs"`
+}
+
+func (o Options) diffRows() int {
+	if !o.Diff {
+		return 0
+	}
+
+	if o.DiffRows < 1 {
+		return defaultDiffRows
+	}
+
+	return o.DiffRows
+}
+
+func (o Options) allowance() float64 {
+	if o.Allowance <= 0 {
+		return defaultAllowance
+	}
+
+	return o.Allowance
+}
+
+func (o Options) profileTop() int {
+	if o.ProfileTop < 1 {
+		return defaultProfileTop
+	}
+
+	return o.ProfileTop
+}
+
+func (o Options) profileDir() string {
+	if o.ProfileDir == "" {
+		return defaultProfileDir
+	}
+
+	return o.ProfileDir
+}
+
+func (o Options) loadDuration() time.Duration {
+	if o.LoadDuration <= 0 {
+		return defaultLoadDuration
+	}
+
+	return o.LoadDuration
+}
@@ -0,0 +1,174 @@
+package gitbase
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// Methods to find outlier runs by their wall time.
+const (
+	OutliersNone = "none"
+	// OutliersIQR discards runs outside of 1.5 interquartile ranges from
+	// the first and third quartiles.
+	OutliersIQR = "iqr"
+	// OutliersMAD discards runs with a modified z-score, based on the
+	// median absolute deviation, over 3.5.
+	OutliersMAD = "mad"
+)
+
+const (
+	iqrFactor    = 1.5
+	madThreshold = 3.5
+)
+
+// ErrUnknownOutliers is returned when the outlier method does not exist.
+var ErrUnknownOutliers = errors.NewKind("unknown outlier method %q")
+
+// Reasons to discard a run.
+const (
+	DiscardWarmup  = "warmup"
+	DiscardOutlier = "outlier"
+)
+
+// Discarded is a run not used to compare the versions.
+type Discarded struct {
+	// Run is the number of the run, warm-up runs are numbered separately.
+	Run    int
+	Reason string
+	*Result
+}
+
+func validOutliers(method string) error {
+	switch method {
+	case "", OutliersNone, OutliersIQR, OutliersMAD:
+		return nil
+	default:
+		return ErrUnknownOutliers.New(method)
+	}
+}
+
+// outlierRuns returns the positions of the runs that are outliers by their
+// wall time. Nothing is discarded when it would leave less than half of the
+// runs.
+func outlierRuns(rs []*Result, method string) []int {
+	walls := make([]float64, len(rs))
+	for i, r := range rs {
+		walls[i] = float64(r.Wtime)
+	}
+
+	var isOutlier func(float64) bool
+	switch method {
+	case OutliersIQR:
+		if len(walls) < 4 {
+			return nil
+		}
+
+		q1, q3 := quantile(walls, 0.25), quantile(walls, 0.75)
+		iqr := q3 - q1
+		low, high := q1-iqrFactor*iqr, q3+iqrFactor*iqr
+		isOutlier = func(v float64) bool {
+			return v < low || v > high
+		}
+	case OutliersMAD:
+		if len(walls) < 3 {
+			return nil
+		}
+
+		m := median(walls)
+		deviations := make([]float64, len(walls))
+		for i, v := range walls {
+			deviations[i] = math.Abs(v - m)
+		}
+
+		mad := median(deviations)
+		if mad == 0 {
+			return nil
+		}
+
+		isOutlier = func(v float64) bool {
+			return math.Abs(0.6745*(v-m)/mad) > madThreshold
+		}
+	default:
+		return nil
+	}
+
+	var outliers []int
+	for i, v := range walls {
+		if isOutlier(v) {
+			outliers = append(outliers, i)
+		}
+	}
+
+	if len(outliers) > len(walls)/2 {
+		return nil
+	}
+
+	return outliers
+}
+
+// removeOutliers splits the runs in kept and discarded outliers. Runs are
+// only filtered when all of them succeeded.
+func removeOutliers(rs []*Result, method string) ([]*Result, []Discarded) {
+	if status(rs) != StatusOK {
+		return rs, nil
+	}
+
+	outliers := outlierRuns(rs, method)
+	if len(outliers) == 0 {
+		return rs, nil
+	}
+
+	var (
+		kept      []*Result
+		discarded []Discarded
+	)
+
+	for i, r := range rs {
+		if len(outliers) > 0 && outliers[0] == i {
+			outliers = outliers[1:]
+			discarded = append(discarded, Discarded{
+				Run:    i + 1,
+				Reason: DiscardOutlier,
+				Result: r,
+			})
+			continue
+		}
+
+		kept = append(kept, r)
+	}
+
+	// the rows used in diffs are only captured in the first run, the
+	// stored results are not modified
+	if kept[0].Tables == nil && rs[0].Tables != nil {
+		capture := *kept[0]
+		capture.Tables = rs[0].Tables
+		kept[0] = &capture
+	}
+
+	return kept, discarded
+}
+
+// quantile returns the q quantile of the values using linear interpolation
+// between closest ranks.
+func quantile(values []float64, q float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	pos := q * float64(len(sorted)-1)
+	low := int(math.Floor(pos))
+	high := int(math.Ceil(pos))
+
+	return sorted[low] + (sorted[high]-sorted[low])*(pos-float64(low))
+}
+
+// printDiscarded shows the runs of a query not used in the comparison.
+func printDiscarded(ds []Discarded, version string) {
+	for _, d := range ds {
+		fmt.Printf("# Discarded - Query.ID: %s version: %s %s run: %d wall: %v status: %s\n",
+			d.ID, version, d.Reason, d.Run, d.Wtime.Round(time.Microsecond), d.Status)
+	}
+}
@@ -0,0 +1,84 @@
+package gitbase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func wallResults(walls ...time.Duration) []*Result {
+	rs := make([]*Result, len(walls))
+	for i, w := range walls {
+		rs[i] = NewResult()
+		rs[i].Status = StatusOK
+		rs[i].Wtime = w
+	}
+
+	return rs
+}
+
+func TestQuantile(t *testing.T) {
+	require := require.New(t)
+
+	values := []float64{4, 1, 3, 2, 5}
+	require.Equal(1.0, quantile(values, 0))
+	require.Equal(2.0, quantile(values, 0.25))
+	require.Equal(3.0, quantile(values, 0.5))
+	require.Equal(5.0, quantile(values, 1))
+	require.Equal(2.5, quantile([]float64{1, 2, 3, 4}, 0.5))
+}
+
+func TestOutlierRuns(t *testing.T) {
+	require := require.New(t)
+
+	rs := wallResults(100, 102, 98, 101, 99, 500)
+	require.Equal([]int{5}, outlierRuns(rs, OutliersIQR))
+	require.Equal([]int{5}, outlierRuns(rs, OutliersMAD))
+	require.Nil(outlierRuns(rs, OutliersNone))
+
+	// not enough runs
+	require.Nil(outlierRuns(wallResults(100, 500, 100), OutliersIQR))
+	require.Nil(outlierRuns(wallResults(100, 500), OutliersMAD))
+
+	// no deviation
+	require.Nil(outlierRuns(wallResults(100, 100, 100, 500), OutliersMAD))
+}
+
+func TestRemoveOutliers(t *testing.T) {
+	require := require.New(t)
+
+	rs := wallResults(500, 100, 102, 98, 101, 99)
+	rs[0].Tables = []*Table{{}}
+
+	kept, discarded := removeOutliers(rs, OutliersIQR)
+	require.Len(kept, 5)
+	require.Equal(rs[1].Wtime, kept[0].Wtime)
+	require.Equal(rs[0].Tables, kept[0].Tables)
+	require.Nil(rs[1].Tables)
+
+	require.Len(discarded, 1)
+	require.Equal(1, discarded[0].Run)
+	require.Equal(DiscardOutlier, discarded[0].Reason)
+	require.Equal(time.Duration(500), discarded[0].Wtime)
+
+	rs[3].Status = StatusError
+	kept, discarded = removeOutliers(rs, OutliersIQR)
+	require.Equal(rs, kept)
+	require.Nil(discarded)
+}
+
+func TestAverage(t *testing.T) {
+	require := require.New(t)
+
+	rs := wallResults(100, 20, 40, time.Second)
+	rs[3].Status = StatusTimeout
+	rs[0].Memory = 10
+	rs[1].Memory = 11
+
+	avg := average(rs)
+	require.Equal(time.Duration(53), avg.Wtime)
+	require.Equal(int64(7), avg.Memory)
+
+	require.Nil(average(rs[3:]))
+}
@@ -0,0 +1,118 @@
+package gitbase
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// clockTicks is the number of clock ticks per second used in /proc. It is
+// 100 in all the supported platforms.
+const clockTicks = 100
+
+// ErrProcFormat is returned when a /proc file can not be parsed.
+var ErrProcFormat = errors.NewKind("unexpected format in %s")
+
+// procUsage holds the resource counters of a running process read from
+// /proc.
+type procUsage struct {
+	Utime time.Duration
+	Stime time.Duration
+	// RSS is the current resident memory in bytes.
+	RSS int64
+	// PeakRSS is the maximum resident memory in bytes since the process
+	// started or the last resetPeakRSS.
+	PeakRSS int64
+}
+
+// readProcUsage reads the cpu times and memory of a process.
+func readProcUsage(pid int) (*procUsage, error) {
+	usage := new(procUsage)
+
+	statPath := fmt.Sprintf("/proc/%d/stat", pid)
+	stat, err := ioutil.ReadFile(statPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the command name can contain spaces, fields start after it
+	text := string(stat)
+	end := strings.LastIndex(text, ")")
+	if end < 0 {
+		return nil, ErrProcFormat.New(statPath)
+	}
+
+	fields := strings.Fields(text[end+1:])
+	// utime and stime are fields 14 and 15, the first one here is 3
+	if len(fields) < 13 {
+		return nil, ErrProcFormat.New(statPath)
+	}
+
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return nil, ErrProcFormat.Wrap(err, statPath)
+	}
+
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return nil, ErrProcFormat.Wrap(err, statPath)
+	}
+
+	usage.Utime = ticksToDuration(utime)
+	usage.Stime = ticksToDuration(stime)
+
+	status, err := readProcStatus(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	usage.RSS = status["VmRSS"]
+	usage.PeakRSS = status["VmHWM"]
+
+	return usage, nil
+}
+
+// readProcStatus returns the values in kB from /proc/<pid>/status converted
+// to bytes.
+func readProcStatus(pid int) (map[string]int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		values[strings.TrimSuffix(fields[0], ":")] = v * 1024
+	}
+
+	return values, scanner.Err()
+}
+
+// resetPeakRSS resets the peak resident memory of a process so it can be
+// measured for a period of time. It needs Linux 4.0 or newer.
+func resetPeakRSS(pid int) error {
+	path := fmt.Sprintf("/proc/%d/clear_refs", pid)
+	return ioutil.WriteFile(path, []byte("5"), 0200)
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockTicks
+}
@@ -0,0 +1,23 @@
+package gitbase
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProcUsage(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc not available")
+	}
+
+	require := require.New(t)
+
+	usage, err := readProcUsage(os.Getpid())
+	require.NoError(err)
+	require.True(usage.RSS > 0)
+	require.True(usage.PeakRSS >= usage.RSS)
+	require.True(usage.Utime >= 0)
+	require.True(usage.Stime >= 0)
+}
@@ -0,0 +1,360 @@
+package gitbase
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	// minProfileTime and maxProfileTime limit the duration of the cpu
+	// profiles.
+	minProfileTime = time.Second
+	maxProfileTime = 30 * time.Second
+	// profileFetchMargin is the time allowed to fetch a profile on top of
+	// its duration.
+	profileFetchMargin = 30 * time.Second
+)
+
+// ErrProfile is returned when a profile can not be fetched or read.
+var ErrProfile = errors.NewKind("could not get %s profile")
+
+// ErrProfileFlag is returned when profiles are enabled without the gitbase
+// flag that serves them.
+var ErrProfileFlag = errors.NewKind("--profile needs the gitbase pprof flag set with --profile-flag")
+
+// Profiles has the paths of the profiles captured for a query.
+type Profiles struct {
+	CPU  string
+	Heap string
+	// HeapBase is the heap profile taken before the runs. Allocations
+	// are the difference between Heap and HeapBase.
+	HeapBase string
+	// Runs is the number of query runs while the profiles were taken,
+	// used to compare versions that ran a different number of times.
+	Runs int
+}
+
+// profileKind describes how to read a type of profile.
+type profileKind struct {
+	Name        string
+	SampleIndex string
+	Unit        string
+}
+
+var (
+	cpuProfile  = profileKind{Name: "CPU", SampleIndex: "cpu", Unit: "ms"}
+	heapProfile = profileKind{Name: "Heap", SampleIndex: "alloc_space", Unit: "B"}
+)
+
+// profileQuery captures the profiles of a query in a new server. The query
+// is run repeatedly while the cpu profile is taken, during its measured
+// wall time rounded up to seconds. Heap profiles are taken before the
+// first run and after the last one so allocations of the server startup
+// are left out.
+func (t *Test) profileQuery(
+	version string,
+	gitbase *regression.Binary,
+	query Query,
+	results []*Result,
+) (*Profiles, error) {
+	dir := filepath.Join(t.options.profileDir(), fileName(version))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	server, err := t.startServer(gitbase, t.testRepos)
+	if err != nil {
+		return nil, err
+	}
+	defer server.Stop()
+
+	profiles := &Profiles{
+		CPU:      filepath.Join(dir, fileName(query.ID)+".cpu.pb.gz"),
+		Heap:     filepath.Join(dir, fileName(query.ID)+".heap.pb.gz"),
+		HeapBase: filepath.Join(dir, fileName(query.ID)+".heap-base.pb.gz"),
+	}
+
+	err = fetchProfile(
+		server.PprofURL()+"/heap", profiles.HeapBase, profileFetchMargin)
+	if err != nil {
+		return nil, ErrProfile.Wrap(err, heapProfile.Name)
+	}
+
+	seconds := int(math.Ceil(profileTime(results).Seconds()))
+	url := fmt.Sprintf("%s/profile?seconds=%d", server.PprofURL(), seconds)
+
+	cpuErr := make(chan error, 1)
+	go func() {
+		timeout := time.Duration(seconds)*time.Second + profileFetchMargin
+		cpuErr <- fetchProfile(url, profiles.CPU, timeout)
+	}()
+
+	for runs := 1; ; runs++ {
+		_, err := t.runServerQuery(server, query, 0, false)
+		if err != nil {
+			<-cpuErr
+			return nil, ErrProfile.Wrap(err, cpuProfile.Name)
+		}
+
+		select {
+		case err := <-cpuErr:
+			if err != nil {
+				return nil, ErrProfile.Wrap(err, cpuProfile.Name)
+			}
+
+			t.log.With(log.Fields{
+				"query.ID": query.ID,
+				"runs":     runs,
+				"seconds":  seconds,
+			}).Infof("CPU profile captured")
+
+			err = fetchProfile(
+				server.PprofURL()+"/heap", profiles.Heap, profileFetchMargin)
+			if err != nil {
+				return nil, ErrProfile.Wrap(err, heapProfile.Name)
+			}
+
+			profiles.Runs = runs
+			return profiles, nil
+		default:
+		}
+	}
+}
+
+// profileTime returns the mean wall time of the successful results limited
+// to the profile duration limits.
+func profileTime(rs []*Result) time.Duration {
+	var (
+		n     int64
+		total time.Duration
+	)
+
+	for _, r := range rs {
+		if r.Status == StatusOK {
+			n++
+			total += r.Wtime
+		}
+	}
+
+	if n == 0 {
+		return minProfileTime
+	}
+
+	d := total / time.Duration(n)
+	switch {
+	case d < minProfileTime:
+		return minProfileTime
+	case d > maxProfileTime:
+		return maxProfileTime
+	default:
+		return d
+	}
+}
+
+// fetchProfile saves the profile served in the url. The request fails if
+// it takes longer than timeout.
+func fetchProfile(url, path string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, res.Status)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, res.Body); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readProfileTop returns the flat value of each function in a profile
+// using "go tool pprof". When base is not empty the values of the base
+// profile are subtracted.
+func readProfileTop(path, base string, kind profileKind) (map[string]float64, error) {
+	args := []string{"tool", "pprof",
+		"-top",
+		"-nodecount=100000",
+		"-nodefraction=0",
+		"-sample_index=" + kind.SampleIndex,
+		"-unit=" + kind.Unit,
+	}
+	if base != "" {
+		args = append(args, "-base", base)
+	}
+	args = append(args, path)
+
+	cmd := exec.Command("go", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, ErrProfile.Wrap(
+			fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String())), kind.Name)
+	}
+
+	return parseProfileTop(bytes.NewReader(out), kind.Unit)
+}
+
+// parseProfileTop reads the output of "pprof -top". The values must be in
+// the given unit.
+func parseProfileTop(r io.Reader, unit string) (map[string]float64, error) {
+	values := make(map[string]float64)
+	header := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !header {
+			header = len(fields) > 0 && fields[0] == "flat"
+			continue
+		}
+
+		if len(fields) < 6 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], unit), 64)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.Join(fields[5:], " ")
+		name = strings.TrimSuffix(name, " (inline)")
+		values[name] += v
+	}
+
+	return values, scanner.Err()
+}
+
+// ProfileChange is the difference of a function flat value between two
+// profiles.
+type ProfileChange struct {
+	Function string
+	A, B     float64
+}
+
+// Delta returns the change from A to B.
+func (c ProfileChange) Delta() float64 {
+	return c.B - c.A
+}
+
+// diffProfiles returns the top functions with the biggest absolute change
+// between two profiles.
+func diffProfiles(a, b map[string]float64, top int) []ProfileChange {
+	changes := make([]ProfileChange, 0, len(a)+len(b))
+	for f, va := range a {
+		changes = append(changes, ProfileChange{Function: f, A: va, B: b[f]})
+	}
+	for f, vb := range b {
+		if _, ok := a[f]; !ok {
+			changes = append(changes, ProfileChange{Function: f, B: vb})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		di, dj := math.Abs(changes[i].Delta()), math.Abs(changes[j].Delta())
+		if di != dj {
+			return di > dj
+		}
+
+		return changes[i].Function < changes[j].Function
+	})
+
+	var result []ProfileChange
+	for _, c := range changes {
+		if len(result) >= top || c.Delta() == 0 {
+			break
+		}
+
+		result = append(result, c)
+	}
+
+	return result
+}
+
+// perRun divides the profile values by the number of runs.
+func perRun(values map[string]float64, runs int) map[string]float64 {
+	if runs < 1 {
+		return values
+	}
+
+	result := make(map[string]float64, len(values))
+	for f, v := range values {
+		result[f] = v / float64(runs)
+	}
+
+	return result
+}
+
+// printProfileDiff shows the functions that changed the most between the
+// profiles of a query in two versions. Values are per query run as each
+// version can run the query a different number of times while profiled.
+func (t *Test) printProfileDiff(versionA, versionB, id string) {
+	a := t.profiles[versionA][id]
+	b := t.profiles[versionB][id]
+	if a == nil || b == nil {
+		fmt.Printf("# Skip - no profiles for one of the versions\n")
+		return
+	}
+
+	kinds := []struct {
+		kind  profileKind
+		pathA string
+		baseA string
+		pathB string
+		baseB string
+	}{
+		{cpuProfile, a.CPU, "", b.CPU, ""},
+		{heapProfile, a.Heap, a.HeapBase, b.Heap, b.HeapBase},
+	}
+
+	for _, k := range kinds {
+		topA, err := readProfileTop(k.pathA, k.baseA, k.kind)
+		if err != nil {
+			t.log.Errorf(err, "Could not read profile")
+			continue
+		}
+
+		topB, err := readProfileTop(k.pathB, k.baseB, k.kind)
+		if err != nil {
+			t.log.Errorf(err, "Could not read profile")
+			continue
+		}
+
+		topA, topB = perRun(topA, a.Runs), perRun(topB, b.Runs)
+
+		fmt.Printf("### %s profile (%s per run, runs %d -> %d): %s -> %s ###\n",
+			k.kind.Name, k.kind.Unit, a.Runs, b.Runs, k.pathA, k.pathB)
+		for _, c := range diffProfiles(topA, topB, t.options.profileTop()) {
+			fmt.Printf("%s: %.0f -> %.0f (%+.0f)\n",
+				c.Function, c.A, c.B, c.Delta())
+		}
+	}
+}
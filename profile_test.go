@@ -0,0 +1,134 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const profileTop = `File: gitbase
+Type: cpu
+Duration: 1s, Total samples = 970ms (97.91%)
+Showing nodes accounting for 970ms, 100% of 970ms total
+      flat  flat%   sum%        cum   cum%
+     900ms 92.78% 92.78%      900ms 92.78%  main.spin (inline)
+      70ms  7.22%   100%      970ms   100%  main.main
+         0     0%   100%      970ms   100%  runtime.main
+`
+
+func TestParseProfileTop(t *testing.T) {
+	require := require.New(t)
+
+	values, err := parseProfileTop(strings.NewReader(profileTop), "ms")
+	require.NoError(err)
+	require.Equal(map[string]float64{
+		"main.spin":    900,
+		"main.main":    70,
+		"runtime.main": 0,
+	}, values)
+}
+
+func TestPerRun(t *testing.T) {
+	require := require.New(t)
+
+	values := map[string]float64{"a": 100, "b": 30}
+	require.Equal(map[string]float64{"a": 25, "b": 7.5}, perRun(values, 4))
+	require.Equal(values, perRun(values, 0))
+}
+
+func TestDiffProfiles(t *testing.T) {
+	require := require.New(t)
+
+	a := map[string]float64{"a": 100, "b": 50, "c": 10}
+	b := map[string]float64{"a": 90, "b": 150, "d": 30}
+
+	require.Equal([]ProfileChange{
+		{Function: "b", A: 50, B: 150},
+		{Function: "d", A: 0, B: 30},
+	}, diffProfiles(a, b, 2))
+
+	require.Len(diffProfiles(a, a, 10), 0)
+}
+
+func TestProfileTime(t *testing.T) {
+	require := require.New(t)
+
+	result := func(wall time.Duration, status Status) *Result {
+		r := NewResult()
+		r.Wtime = wall
+		r.Status = status
+		return r
+	}
+
+	require.Equal(minProfileTime, profileTime(nil))
+	require.Equal(2*time.Second, profileTime([]*Result{
+		result(time.Second, StatusOK),
+		result(3*time.Second, StatusOK),
+		result(time.Hour, StatusTimeout),
+	}))
+	require.Equal(maxProfileTime, profileTime([]*Result{result(time.Hour, StatusOK)}))
+}
+
+func TestReadProfileTop(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "heap.pb.gz")
+	f, err := os.Create(path)
+	require.NoError(err)
+	require.NoError(pprof.WriteHeapProfile(f))
+	require.NoError(f.Close())
+
+	_, err = readProfileTop(path, "", heapProfile)
+	require.NoError(err)
+
+	values, err := readProfileTop(path, path, heapProfile)
+	require.NoError(err)
+	for f, v := range values {
+		require.Zero(v, f)
+	}
+}
+
+func TestFetchProfile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hang" {
+				<-done
+				return
+			}
+
+			_, _ = w.Write([]byte("profile"))
+		}))
+	defer server.Close()
+	// hanging requests must end before closing the server
+	defer close(done)
+
+	path := filepath.Join(dir, "cpu.pb.gz")
+	require.NoError(fetchProfile(server.URL+"/profile", path, time.Second))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal("profile", string(data))
+
+	start := time.Now()
+	require.Error(fetchProfile(server.URL+"/hang", path, 50*time.Millisecond))
+	require.True(time.Since(start) < time.Second)
+}
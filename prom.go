@@ -12,30 +12,44 @@ const (
 	SSeconds  = "regression_gitbase_s_avg_seconds"
 	USeconds  = "regression_gitbase_u_avg_seconds"
 	MemoryMiB = "regression_gitbase_mem_avg_mib"
+	DiskMiB   = "regression_gitbase_disk_avg_mib"
+	DiskFiles = "regression_gitbase_disk_avg_files"
 )
 
 var labels = []string{"version", "name", "branch", "commit"}
 
+// filterLabel is only added to the metrics of runs with a query filter so
+// the metrics of complete runs keep their labels.
+const filterLabel = "filter"
+
 type metrics map[string]*prometheus.SummaryVec
 
 // PromClient is the wrapper around pusher that also keeps metrics
 type PromClient struct {
 	pusher  *push.Pusher
 	metrics metrics
+	filter  string
 }
 
-// NewPromClient inits new pusher, creates metrics and adds them to the collector
-func NewPromClient(p regression.PromConfig) *PromClient {
+// NewPromClient inits new pusher, creates metrics and adds them to the collector.
+// When filter is not empty the metrics have a filter label with its value.
+func NewPromClient(p regression.PromConfig, filter string) *PromClient {
 	pusher := push.New(p.Address, p.Job)
 	log.Debugf("adding metrics to the pusher")
 
-	metrics := getMetrics(labels)
+	l := labels
+	if filter != "" {
+		l = append(append([]string(nil), labels...), filterLabel)
+	}
+
+	metrics := getMetrics(l)
 	for _, m := range metrics {
 		pusher.Collector(m)
 	}
 	return &PromClient{
 		pusher:  pusher,
 		metrics: metrics,
+		filter:  filter,
 	}
 }
 
@@ -44,8 +58,11 @@ func toMiB(i int64) float64 {
 }
 
 // Dump does observations and adds metrics to the pusher
-func (p *PromClient) Dump(res *regression.Result, version, name, branch, commit string) error {
+func (p *PromClient) Dump(res *Result, version, name, branch, commit string) error {
 	labelValues := []string{version, name, branch, commit}
+	if p.filter != "" {
+		labelValues = append(labelValues, p.filter)
+	}
 	observe := func(metric string, value float64) {
 		p.metrics[metric].WithLabelValues(labelValues...).Observe(value)
 	}
@@ -53,6 +70,10 @@ func (p *PromClient) Dump(res *regression.Result, version, name, branch, commit
 	observe(SSeconds, res.Stime.Seconds())
 	observe(USeconds, res.Utime.Seconds())
 	observe(MemoryMiB, toMiB(res.Memory))
+	if res.Disk != nil {
+		observe(DiskMiB, toMiB(res.Disk.Bytes))
+		observe(DiskFiles, float64(res.Disk.Files))
+	}
 
 	log.Debugf("pushing metrics")
 	return p.pusher.Add()
@@ -64,6 +85,8 @@ func getMetrics(labels []string) metrics {
 		SSeconds:  getMetric(SSeconds, labels),
 		USeconds:  getMetric(USeconds, labels),
 		MemoryMiB: getMetric(MemoryMiB, labels),
+		DiskMiB:   getMetric(DiskMiB, labels),
+		DiskFiles: getMetric(DiskFiles, labels),
 	}
 }
 
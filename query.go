@@ -4,9 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"io/ioutil"
+	"time"
 
+	"github.com/Masterminds/semver"
 	// Load mysql drivers.
 	_ "github.com/go-sql-driver/mysql"
+	"gopkg.in/src-d/go-errors.v1"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,14 +19,220 @@ type Query struct {
 	ID         string   `yaml:"ID"`
 	Name       string   `yaml:"Name,omitempty"`
 	Statements []string `yaml:"Statements"`
+	// Tags are used to select groups of queries.
+	Tags []string `yaml:"Tags,omitempty"`
+	// Setup has statements executed before Statements in the same
+	// connection. They are not measured.
+	Setup []string `yaml:"Setup,omitempty"`
+	// Teardown has statements executed after Statements in the same
+	// connection. They are not measured.
+	Teardown []string `yaml:"Teardown,omitempty"`
+	// Ordered marks queries where the order of the rows is part of the
+	// expected result.
+	Ordered bool `yaml:"Ordered,omitempty"`
+	// Key has the columns that identify a row when showing the differences
+	// between the results of two versions. All the columns are used when
+	// it is empty.
+	Key []string `yaml:"Key,omitempty"`
+	// Allowance has the maximum percentage of change allowed per metric.
+	// Metrics not in the map use the default allowance. The concurrent
+	// load mode uses the wall time allowance for the query latencies.
+	Allowance map[string]float64 `yaml:"Allowance,omitempty"`
+	// Fail has the metrics that fail the run when they are over the
+	// allowance. By default wall time, memory and rows fail.
+	Fail []string `yaml:"Fail,omitempty"`
+	// Timeout is the maximum time the statements can run. The run is
+	// recorded as timed out and the server is killed when it expires. In
+	// the concurrent load mode the query is counted as an error and the
+	// server keeps running for the other clients.
+	Timeout time.Duration `yaml:"Timeout,omitempty"`
+	// Session selects how statements use connections, it can be "shared"
+	// (default) or "per-statement".
+	Session string `yaml:"Session,omitempty"`
+	// MinVersion is the first gitbase version where the query can run. It
+	// is a semantic version or a build date as YYYY-MM-DD, compared with
+	// the date reported by "gitbase version".
+	MinVersion string `yaml:"MinVersion,omitempty"`
+	// MaxVersion is the last gitbase version where the query can run, in
+	// the same format as MinVersion.
+	MaxVersion string `yaml:"MaxVersion,omitempty"`
+	// Weight is the relative frequency of the query in the concurrent load
+	// mode. It is 1 by default.
+	Weight int `yaml:"Weight,omitempty"`
+}
+
+// Session models of a query.
+const (
+	// SessionShared runs setup, statements and teardown in the same
+	// connection.
+	SessionShared = "shared"
+	// SessionPerStatement runs each statement in a new connection. Setup
+	// and teardown share a connection.
+	SessionPerStatement = "per-statement"
+)
+
+// ErrUnknownMetric is returned when a query references a metric that does
+// not exist.
+var ErrUnknownMetric = errors.NewKind("query %s: unknown metric %q")
+
+// ErrInvalidVersion is returned when a query version range is not valid.
+var ErrInvalidVersion = errors.NewKind("query %s: invalid version %q")
+
+// ErrUnknownSession is returned when a query has an invalid session model.
+var ErrUnknownSession = errors.NewKind("query %s: unknown session %q")
+
+// validate checks that the session model and the metrics used by the query
+// exist and that its version range is valid.
+func (q Query) validate() error {
+	switch q.Session {
+	case "", SessionShared, SessionPerStatement:
+	default:
+		return ErrUnknownSession.New(q.ID, q.Session)
+	}
+
+	for _, v := range []string{q.MinVersion, q.MaxVersion} {
+		if v == "" {
+			continue
+		}
+
+		if _, _, err := parseVersionBound(v); err != nil {
+			return ErrInvalidVersion.Wrap(err, q.ID, v)
+		}
+	}
+
+	metrics := make([]string, 0, len(q.Allowance)+len(q.Fail))
+	for m := range q.Allowance {
+		metrics = append(metrics, m)
+	}
+	metrics = append(metrics, q.Fail...)
+
+	for _, m := range metrics {
+		if !contains(metricNames, m) {
+			return ErrUnknownMetric.New(q.ID, m)
+		}
+	}
+
+	return nil
+}
+
+// applies returns true if the version and build date are inside the query
+// version range. Semantic version limits are checked with the version and
+// build date limits with the date. Queries apply to unknown versions and
+// dates.
+func (q Query) applies(v *semver.Version, build time.Time) bool {
+	if q.MinVersion != "" {
+		min, minBuild, err := parseVersionBound(q.MinVersion)
+		switch {
+		case err != nil:
+		case min != nil && v != nil && v.LessThan(min):
+			return false
+		case !minBuild.IsZero() && !build.IsZero() && build.Before(minBuild):
+			return false
+		}
+	}
+
+	if q.MaxVersion != "" {
+		max, maxBuild, err := parseVersionBound(q.MaxVersion)
+		switch {
+		case err != nil:
+		case max != nil && v != nil && v.GreaterThan(max):
+			return false
+		// builds of the same day are inside the range
+		case !maxBuild.IsZero() && !build.IsZero() &&
+			!build.Before(maxBuild.AddDate(0, 0, 1)):
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseVersionBound reads a limit of a query version range, a build date or
+// a semantic version. Dates are checked first as semver accepts them.
+func parseVersionBound(s string) (*semver.Version, time.Time, error) {
+	if build, err := time.Parse(buildLayouts[0], s); err == nil {
+		return nil, build, nil
+	}
+
+	v, err := semver.NewVersion(s)
+	return v, time.Time{}, err
+}
+
+func (q Query) weight() int {
+	if q.Weight < 1 {
+		return 1
+	}
+
+	return q.Weight
+}
+
+// allowance returns the allowance for a metric or def if the query does not
+// define it.
+func (q Query) allowance(metric string, def float64) float64 {
+	if a, ok := q.Allowance[metric]; ok {
+		return a
+	}
+
+	return def
+}
+
+// fails returns true if a metric over the allowance fails the run.
+func (q Query) fails(metric string) bool {
+	if q.Fail == nil {
+		return contains(defaultFail, metric)
+	}
+
+	return contains(q.Fail, metric)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Output holds the rows returned by the statements of a query.
+type Output struct {
+	// Rows is the number of rows returned by all the statements.
+	Rows int64
+	// Checksum identifies the contents of the returned rows.
+	Checksum Checksum
+	// Tables has the rows returned by each statement when capture is
+	// enabled.
+	Tables []*Table
+	// Timings has the time spent by each statement.
+	Timings []StatementTiming
+}
+
+// StatementTiming holds the time spent by a statement in each phase. All
+// the durations are measured from the start of the statement.
+type StatementTiming struct {
+	// Query is the time until the server accepted the statement.
+	Query time.Duration
+	// FirstRow is the time until the first row was read or until the end
+	// of the results if there are no rows.
+	FirstRow time.Duration
+	// Total is the time until all the rows were read.
+	Total time.Duration
+	// Rows is the number of rows returned.
+	Rows int64
 }
 
 // SQLTest holds are the queries that belong to a test and connection
-// functionality.
+// functionality. A connection is kept for the whole life of the test so
+// session state is shared between statements.
 type SQLTest struct {
 	Query Query
 	URL   string
-	db    *sql.DB
+	// Capture is the maximum number of rows per statement saved in the
+	// output. Rows are not saved when it is 0.
+	Capture int
+	db      *sql.DB
+	conn    *sql.Conn
 }
 
 // NewSQLTest creates a new SQLTest.
@@ -41,49 +250,170 @@ func (q *SQLTest) Connect() error {
 		return err
 	}
 
+	// closed connections are not reused so per statement sessions always
+	// start clean
+	db.SetMaxIdleConns(0)
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+
 	q.db = db
+	q.conn = conn
 
 	return nil
 }
 
 // Disconnect closes the mysql connection.
 func (q *SQLTest) Disconnect() error {
-	return q.db.Close()
+	err := q.conn.Close()
+	if cerr := q.db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// statementConn returns the connection used to run a statement and a
+// function to release it.
+func (q *SQLTest) statementConn(ctx context.Context) (*sql.Conn, func(), error) {
+	if q.Query.Session != SessionPerStatement {
+		return q.conn, func() {}, nil
+	}
+
+	conn, err := q.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, func() { _ = conn.Close() }, nil
 }
 
-func (q *SQLTest) ExecuteCtx(ctx context.Context) (int64, error) {
-	var count int64
+// ExecuteCtx runs the query statements on the gitbase server and returns
+// the number of rows and their checksums.
+func (q *SQLTest) ExecuteCtx(ctx context.Context) (*Output, error) {
+	out := new(Output)
+	h := newHasher()
 
 	for _, s := range q.Query.Statements {
-		rows, err := q.db.QueryContext(ctx, s)
+		h.next()
+
+		conn, release, err := q.statementConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+
+		rows, err := conn.QueryContext(ctx, s)
 		if err != nil {
-			return 0, err
+			release()
+			return nil, err
 		}
 
-		for rows.Next() {
-			count++
+		timing := StatementTiming{Query: time.Since(start)}
+
+		var table *Table
+		if q.Capture > 0 {
+			table = &Table{Limit: q.Capture}
+			out.Tables = append(out.Tables, table)
+		}
+
+		err = scanRows(rows, h, table, start, &timing)
+		release()
+		if err != nil {
+			return nil, err
 		}
+
+		timing.Total = time.Since(start)
+		out.Timings = append(out.Timings, timing)
+		out.Rows += timing.Rows
 	}
 
-	return count, nil
+	out.Checksum = h.sum()
+	return out, nil
+}
+
+// Setup runs the setup statements of the query.
+func (q *SQLTest) Setup(ctx context.Context) error {
+	return q.exec(ctx, q.Query.Setup)
+}
+
+// Teardown runs the teardown statements of the query.
+func (q *SQLTest) Teardown(ctx context.Context) error {
+	return q.exec(ctx, q.Query.Teardown)
+}
+
+// exec runs statements discarding their results.
+func (q *SQLTest) exec(ctx context.Context, statements []string) error {
+	for _, s := range statements {
+		if _, err := q.conn.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Execute runs sql query on the gitbase server.
-func (q *SQLTest) Execute() (int64, error) {
-	var count int64
+func (q *SQLTest) Execute() (*Output, error) {
+	return q.ExecuteCtx(context.Background())
+}
 
-	for _, s := range q.Query.Statements {
-		rows, err := q.db.Query(s)
-		if err != nil {
-			return 0, err
+// scanRows reads all the rows from a result set adding them to the hasher
+// and to the table when it is not nil. The number of rows and the time to
+// the first row since start are saved in timing.
+func scanRows(
+	rows *sql.Rows,
+	h *hasher,
+	table *Table,
+	start time.Time,
+	timing *StatementTiming,
+) error {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	if table != nil {
+		table.Columns = columns
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if timing.Rows == 0 {
+			timing.FirstRow = time.Since(start)
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return err
 		}
 
-		for rows.Next() {
-			count++
+		h.add(values)
+		if table != nil {
+			table.add(values)
 		}
+		timing.Rows++
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	return count, nil
+	if timing.Rows == 0 {
+		timing.FirstRow = time.Since(start)
+	}
+
+	return nil
 }
 
 func loadQueriesYaml(file string) ([]Query, error) {
@@ -98,5 +428,11 @@ func loadQueriesYaml(file string) ([]Query, error) {
 		return nil, err
 	}
 
+	for _, query := range q {
+		if err := query.validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	return q, nil
 }
@@ -0,0 +1,157 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeQueries(t *testing.T, text string) string {
+	f, err := ioutil.TempFile("", "regression")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(text)
+	require.NoError(t, err)
+
+	return f.Name()
+}
+
+func TestLoadQueriesYaml(t *testing.T) {
+	require := require.New(t)
+
+	file := writeQueries(t, `
+- ID: q1
+  Statements:
+    - select 1
+  Allowance:
+    wall: 25
+  Fail: [memory]
+  Timeout: 30s
+- ID: q2
+  Statements:
+    - select 2
+`)
+	defer os.Remove(file)
+
+	queries, err := loadQueriesYaml(file)
+	require.NoError(err)
+	require.Len(queries, 2)
+
+	q1, q2 := queries[0], queries[1]
+	require.Equal(25.0, q1.allowance(MetricWall, 10))
+	require.Equal(10.0, q1.allowance(MetricMemory, 10))
+	require.True(q1.fails(MetricMemory))
+	require.False(q1.fails(MetricWall))
+	require.Equal(30*time.Second, q1.Timeout)
+
+	require.True(q2.fails(MetricWall))
+	require.True(q2.fails(MetricRows))
+	require.False(q2.fails(MetricUser))
+}
+
+func TestLoadQueriesYamlSetup(t *testing.T) {
+	require := require.New(t)
+
+	file := writeQueries(t, `
+- ID: q1
+  Setup:
+    - SET inmemory_joins = 1
+  Statements:
+    - select 1
+  Teardown:
+    - SET inmemory_joins = 0
+    - DROP INDEX idx ON files
+- ID: q2
+  Statements:
+    - select 2
+`)
+	defer os.Remove(file)
+
+	queries, err := loadQueriesYaml(file)
+	require.NoError(err)
+	require.Len(queries, 2)
+
+	require.Equal([]string{"SET inmemory_joins = 1"}, queries[0].Setup)
+	require.Equal([]string{
+		"SET inmemory_joins = 0",
+		"DROP INDEX idx ON files",
+	}, queries[0].Teardown)
+	require.Nil(queries[1].Setup)
+	require.Nil(queries[1].Teardown)
+}
+
+func TestLoadQueriesYamlUnknownMetric(t *testing.T) {
+	require := require.New(t)
+
+	file := writeQueries(t, `
+- ID: q1
+  Statements:
+    - select 1
+  Fail: [cpu]
+`)
+	defer os.Remove(file)
+
+	_, err := loadQueriesYaml(file)
+	require.True(ErrUnknownMetric.Is(err))
+}
+
+func TestLoadQueriesYamlUnknownSession(t *testing.T) {
+	require := require.New(t)
+
+	file := writeQueries(t, `
+- ID: q1
+  Statements:
+    - select 1
+  Session: pooled
+`)
+	defer os.Remove(file)
+
+	_, err := loadQueriesYaml(file)
+	require.True(ErrUnknownSession.Is(err))
+}
+
+func TestQueryApplies(t *testing.T) {
+	require := require.New(t)
+
+	q := Query{ID: "q", MinVersion: "v0.20.0", MaxVersion: "0.24.0"}
+	require.NoError(q.validate())
+
+	var unknown time.Time
+	require.True(q.applies(nil, unknown))
+	require.False(q.applies(parseVersion("gitbase (v0.19.1) - build 2019-02-01"), unknown))
+	require.True(q.applies(parseVersion("gitbase (v0.20.0) - build 2019-04-01"), unknown))
+	require.True(q.applies(parseVersion("v0.24.0"), unknown))
+	require.False(q.applies(parseVersion("v0.24.1"), unknown))
+	require.Nil(parseVersion("gitbase (undefined) - build undefined"))
+
+	// build date constraints
+	q = Query{ID: "q", MinVersion: "2019-04-01", MaxVersion: "2019-06-30"}
+	require.NoError(q.validate())
+
+	build := func(text string) time.Time {
+		b := parseBuild(text)
+		require.False(b.IsZero(), text)
+		return b
+	}
+
+	require.True(q.applies(nil, unknown))
+	require.False(q.applies(nil, build("gitbase (dev) - build 2019-03-31")))
+	require.True(q.applies(nil, build("gitbase (dev) - build 04-01-2019_10_00_00")))
+	require.True(q.applies(nil, build("gitbase (dev) - build 2019-06-30T23:00:00Z")))
+	require.False(q.applies(nil, build("gitbase (dev) - build 2019-07-01")))
+	require.True(parseBuild("gitbase (undefined) - build undefined").IsZero())
+
+	// both kinds of limits
+	q = Query{ID: "q", MinVersion: "v0.20.0", MaxVersion: "2019-06-30"}
+	require.NoError(q.validate())
+	require.False(q.applies(parseVersion("v0.19.0"), unknown))
+	require.False(q.applies(parseVersion("v0.21.0"), build("build 2019-08-01")))
+	require.True(q.applies(parseVersion("v0.21.0"), build("build 2019-05-01")))
+
+	q.MaxVersion = "latest"
+	require.True(ErrInvalidVersion.Is(q.validate()))
+}
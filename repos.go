@@ -0,0 +1,255 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// Formats of the repositories served by gitbase.
+const (
+	// RepoFormatPlain serves a directory of git repositories.
+	RepoFormatPlain = "plain"
+	// RepoFormatSiva serves a directory of siva files, each one with a
+	// bare repository.
+	RepoFormatSiva = "siva"
+)
+
+// ErrUnknownFormat is returned when the repository format is not valid.
+var ErrUnknownFormat = errors.NewKind("unknown repository format %q")
+
+// ErrInvalidRoot is returned when a repository root is not valid.
+var ErrInvalidRoot = errors.NewKind("invalid repository root %q")
+
+// ErrMixedRoots is returned when a gitbase version can not serve plain and
+// siva roots at the same time.
+var ErrMixedRoots = errors.NewKind("gitbase %s can not serve plain and siva repository roots together: %s")
+
+// ErrSivaConversion is returned when a repository can not be converted to
+// siva.
+var ErrSivaConversion = errors.NewKind("could not convert %s to siva")
+
+// RepoRoot is a directory with repositories served by gitbase.
+type RepoRoot struct {
+	Path string
+	// Format of the repositories, plain by default.
+	Format string
+}
+
+// String returns the root in the format used by parseRepoRoot.
+func (r RepoRoot) String() string {
+	if r.Format == "" {
+		return r.Path
+	}
+
+	return r.Format + ":" + r.Path
+}
+
+// parseRepoRoot reads a root in the format [plain:|siva:]path.
+func parseRepoRoot(s string) (RepoRoot, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 && (parts[0] == RepoFormatPlain || parts[0] == RepoFormatSiva) {
+		return RepoRoot{Path: parts[1], Format: parts[0]}, nil
+	}
+
+	if s == "" {
+		return RepoRoot{}, ErrInvalidRoot.New(s)
+	}
+
+	return RepoRoot{Path: s}, nil
+}
+
+// rootsString formats a list of roots for logs.
+func rootsString(roots []RepoRoot) string {
+	list := make([]string, len(roots))
+	for i, r := range roots {
+		list[i] = r.String()
+	}
+
+	return strings.Join(list, ",")
+}
+
+// sivaRootsVersion is the first gitbase version without "-s", it serves
+// siva files with "--format siva" instead.
+var sivaRootsVersion = semver.MustParse("v0.24.0")
+
+// mixedRoots returns true when the roots have both plain and siva formats.
+func mixedRoots(roots []RepoRoot) bool {
+	var plain, siva bool
+	for _, r := range roots {
+		if r.Format == RepoFormatSiva {
+			siva = true
+		} else {
+			plain = true
+		}
+	}
+
+	return plain && siva
+}
+
+// checkRoots returns an error when the gitbase version can not serve the
+// roots. Mixed formats need "-s", removed in v0.24.0. Unknown versions are
+// not checked.
+func checkRoots(roots []RepoRoot, v *semver.Version) error {
+	if v == nil || !mixedRoots(roots) || v.LessThan(sivaRootsVersion) {
+		return nil
+	}
+
+	return ErrMixedRoots.New(v, rootsString(roots))
+}
+
+// sivaLayoutArgs select the layout of the siva files written by sivaRepos
+// in gitbase v0.24.0 and newer: files directly in the root, without
+// buckets, each one with a single repository that is not rooted.
+var sivaLayoutArgs = []string{"--bucket", "0", "--non-rooted"}
+
+// rootArgs returns the gitbase server arguments used to serve the roots
+// with the given gitbase version. From v0.24.0, or when the version is
+// unknown, siva roots are served with "--format siva" and the layout of
+// sivaLayoutArgs and must not be mixed with plain ones, see checkRoots.
+// Older versions use "-s" for siva roots.
+func rootArgs(roots []RepoRoot, v *semver.Version) []string {
+	sivaFormat := len(roots) > 0 && (v == nil || !v.LessThan(sivaRootsVersion))
+	for _, r := range roots {
+		if r.Format != RepoFormatSiva {
+			sivaFormat = false
+		}
+	}
+
+	var args []string
+	if sivaFormat {
+		args = append(args, "--format", RepoFormatSiva)
+		args = append(args, sivaLayoutArgs...)
+	}
+
+	for _, r := range roots {
+		flag := "-g"
+		if r.Format == RepoFormatSiva && !sivaFormat {
+			flag = "-s"
+		}
+
+		args = append(args, flag, r.Path)
+	}
+
+	return args
+}
+
+// splitRepos moves the repositories of a directory to n new temporary
+// directories, distributing them in turns.
+func splitRepos(dir string, n int) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i], err = regression.CreateTempDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var i int
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		to := filepath.Join(dirs[i%n], e.Name())
+		if err := os.Rename(filepath.Join(dir, e.Name()), to); err != nil {
+			return nil, err
+		}
+		i++
+	}
+
+	return dirs, nil
+}
+
+func validRepoFormat(format string) error {
+	switch format {
+	case "", RepoFormatPlain, RepoFormatSiva:
+		return nil
+	default:
+		return ErrUnknownFormat.New(format)
+	}
+}
+
+// sivaRepos converts the repositories in a directory to siva files in a
+// new temporary directory. Each repository is cloned as bare and packed
+// with the siva command.
+func sivaRepos(l log.Logger, dir string) (string, error) {
+	if _, err := exec.LookPath("siva"); err != nil {
+		return "", ErrSivaConversion.Wrap(err, dir)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	sivaDir, err := regression.CreateTempDir()
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		file := filepath.Join(sivaDir, e.Name()+".siva")
+
+		l.With(log.Fields{
+			"repo": path,
+			"siva": file,
+		}).Debugf("Converting repository to siva")
+
+		if err := sivaRepo(path, file); err != nil {
+			_ = os.RemoveAll(sivaDir)
+			return "", ErrSivaConversion.Wrap(err, path)
+		}
+	}
+
+	return sivaDir, nil
+}
+
+// sivaRepo packs a bare clone of a repository into a siva file.
+func sivaRepo(repo, file string) error {
+	tmpDir, err := regression.CreateTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bare := filepath.Join(tmpDir, "repo.git")
+	clone := exec.Command("git", "clone", "--quiet", "--mirror", repo, bare)
+	clone.Stderr = os.Stderr
+	if err := clone.Run(); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(bare)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"pack", file}
+	for _, f := range files {
+		args = append(args, f.Name())
+	}
+
+	pack := exec.Command("siva", args...)
+	pack.Dir = bare
+	pack.Stderr = os.Stderr
+
+	return pack.Run()
+}
@@ -0,0 +1,182 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func TestSivaRepos(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// fake siva command that writes the files it packs
+	bin := filepath.Join(dir, "bin")
+	require.NoError(os.Mkdir(bin, 0755))
+	err = ioutil.WriteFile(filepath.Join(bin, "siva"), []byte(
+		"#!/bin/sh\nshift\nfile=$1\nshift\necho \"$@\" > \"$file\"\n"), 0755)
+	require.NoError(err)
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", bin+":"+path)
+
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "repo")
+	require.NoError(os.MkdirAll(repo, 0755))
+	out, err := exec.Command("git", "init", "--quiet", repo).CombinedOutput()
+	require.NoError(err, string(out))
+
+	sivaDir, err := sivaRepos(log.New(nil), repos)
+	require.NoError(err)
+	defer os.RemoveAll(sivaDir)
+
+	packed, err := ioutil.ReadFile(filepath.Join(sivaDir, "repo.siva"))
+	require.NoError(err)
+
+	files := strings.Fields(string(packed))
+	require.Contains(files, "HEAD")
+	require.Contains(files, "config")
+}
+
+func TestSivaReposReadable(t *testing.T) {
+	require := require.New(t)
+
+	if _, err := exec.LookPath("siva"); err != nil {
+		t.Skip("siva command not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		require.NoError(err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "repo")
+	git("init", "--quiet", repo)
+	require.NoError(ioutil.WriteFile(filepath.Join(repo, "README"), []byte("test"), 0644))
+	git("-C", repo, "add", "README")
+	git("-C", repo, "commit", "--quiet", "-m", "initial")
+	head := git("-C", repo, "rev-parse", "HEAD")
+
+	sivaDir, err := sivaRepos(log.New(nil), repos)
+	require.NoError(err)
+	defer os.RemoveAll(sivaDir)
+
+	// files are not bucketed, as served with --bucket 0
+	entries, err := ioutil.ReadDir(sivaDir)
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Equal("repo.siva", entries[0].Name())
+
+	// the siva file has a bare repository in its root, as served with
+	// --non-rooted
+	unpacked := filepath.Join(dir, "unpacked")
+	out, err := exec.Command("siva", "unpack",
+		filepath.Join(sivaDir, "repo.siva"), unpacked).CombinedOutput()
+	require.NoError(err, string(out))
+	require.Equal(head, git("--git-dir", unpacked, "rev-parse", "HEAD"))
+	require.Equal("initial", git("--git-dir", unpacked, "log", "-1", "--format=%s"))
+}
+
+func TestRepoFormat(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(validRepoFormat(RepoFormatSiva))
+	require.True(ErrUnknownFormat.Is(validRepoFormat("zip")))
+}
+
+func TestParseRepoRoot(t *testing.T) {
+	require := require.New(t)
+
+	root, err := parseRepoRoot("siva:/data/vol1")
+	require.NoError(err)
+	require.Equal(RepoRoot{Path: "/data/vol1", Format: RepoFormatSiva}, root)
+
+	root, err = parseRepoRoot("/data/a:b")
+	require.NoError(err)
+	require.Equal(RepoRoot{Path: "/data/a:b"}, root)
+
+	_, err = parseRepoRoot("")
+	require.True(ErrInvalidRoot.Is(err))
+}
+
+func TestRootArgs(t *testing.T) {
+	require := require.New(t)
+
+	plain := RepoRoot{Path: "a", Format: RepoFormatPlain}
+	siva := RepoRoot{Path: "b", Format: RepoFormatSiva}
+
+	old := semver.MustParse("v0.23.1")
+	current := semver.MustParse("v0.24.0")
+
+	require.Equal([]string{"-g", "a", "-g", "b"},
+		rootArgs([]RepoRoot{plain, {Path: "b"}}, current))
+	require.Equal([]string{"--format", "siva", "--bucket", "0", "--non-rooted", "-g", "b", "-g", "b"},
+		rootArgs([]RepoRoot{siva, siva}, current))
+	require.Equal([]string{"--format", "siva", "--bucket", "0", "--non-rooted", "-g", "b"},
+		rootArgs([]RepoRoot{siva}, nil))
+	require.Equal([]string{"-s", "b", "-s", "b"},
+		rootArgs([]RepoRoot{siva, siva}, old))
+	require.Equal([]string{"-g", "a", "-s", "b"},
+		rootArgs([]RepoRoot{plain, siva}, old))
+}
+
+func TestCheckRoots(t *testing.T) {
+	require := require.New(t)
+
+	plain := RepoRoot{Path: "a"}
+	siva := RepoRoot{Path: "b", Format: RepoFormatSiva}
+	mixed := []RepoRoot{plain, siva}
+
+	require.NoError(checkRoots(mixed, semver.MustParse("v0.23.1")))
+	require.NoError(checkRoots(mixed, nil))
+	require.NoError(checkRoots([]RepoRoot{siva, siva}, semver.MustParse("v0.24.0")))
+	require.True(ErrMixedRoots.Is(checkRoots(mixed, semver.MustParse("v0.24.0"))))
+}
+
+func TestSplitRepos(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "regression")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+
+	dirs, err := splitRepos(dir, 2)
+	require.NoError(err)
+	for _, d := range dirs {
+		defer os.RemoveAll(d)
+	}
+
+	var count []int
+	for _, d := range dirs {
+		entries, err := ioutil.ReadDir(d)
+		require.NoError(err)
+		count = append(count, len(entries))
+	}
+
+	require.Equal([]int{2, 1}, count)
+}
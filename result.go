@@ -2,10 +2,64 @@ package gitbase
 
 import (
 	"fmt"
+	"time"
 
 	regression "github.com/src-d/regression-core"
+	"gopkg.in/src-d/go-errors.v1"
 )
 
+// Names of the metrics compared between versions.
+const (
+	MetricWall   = "wall"
+	MetricUser   = "user"
+	MetricSystem = "system"
+	MetricMemory = "memory"
+	MetricRows   = "rows"
+	// MetricStartup is the time the server took to accept connections.
+	MetricStartup = "startup"
+	// MetricStartupMemory is the server memory when it was ready.
+	MetricStartupMemory = "startup-memory"
+	// MetricDisk is the size of the index directory.
+	MetricDisk = "disk"
+	// MetricDiskFiles is the number of files in the index directory.
+	MetricDiskFiles = "disk-files"
+)
+
+var metricNames = []string{
+	MetricWall,
+	MetricUser,
+	MetricSystem,
+	MetricMemory,
+	MetricRows,
+	MetricStartup,
+	MetricStartupMemory,
+	MetricDisk,
+	MetricDiskFiles,
+}
+
+// defaultFail has the metrics that fail the run when a query does not
+// specify them.
+var defaultFail = []string{MetricWall, MetricMemory, MetricRows}
+
+// Status is the outcome of a query run.
+type Status string
+
+// Possible statuses of a query run.
+const (
+	StatusOK      Status = "ok"
+	StatusError   Status = "error"
+	StatusTimeout Status = "timeout"
+	// StatusSetupError is used when the setup statements fail and the
+	// query is not run.
+	StatusSetupError Status = "setup-error"
+	// StatusNotApplicable is used when the query is not run because the
+	// version is outside of its version range.
+	StatusNotApplicable Status = "n/a"
+)
+
+// ErrTimeout is returned when a query does not finish before its timeout.
+var ErrTimeout = errors.NewKind("query %s timed out after %s")
+
 // Comparison struct holds the percentage difference between two results.
 type Comparison struct {
 	regression.Comparison
@@ -13,34 +67,327 @@ type Comparison struct {
 	Rows float64
 }
 
-// Result holds the resources and number of rows from a version test.
+// Result holds the resources, number of rows and rows checksum from a
+// version test.
 type Result struct {
 	*regression.Result
 	Query
-	Rows int64
+	Rows     int64
+	Checksum Checksum
+	// Tables has the rows returned by the query when diffs are enabled.
+	Tables []*Table
+	// Timings has the time spent by each statement.
+	Timings []StatementTiming
+	// Status is the outcome of the run.
+	Status Status
+	// Error has the error message when the run did not succeed.
+	Error string
+	// SetupError has the error returned by the setup statements.
+	SetupError string
+	// TeardownError has the error returned by the teardown statements.
+	TeardownError string
+	// Startup is the time the server took to accept connections. It is 0
+	// when the run reused a server.
+	Startup time.Duration
+	// StartupMemory is the server resident memory in bytes when it was
+	// ready.
+	StartupMemory int64
+	// Disk is the usage of the server index directory after the run. It
+	// is nil when it could not be measured.
+	Disk *DiskUsage
+	// Args are the extra arguments of the server that ran the query.
+	Args []string
+	// Samples has the server resource counters sampled while the
+	// statements ran.
+	Samples []Sample
+	// Run is the number of the measured run, starting at 1. It is kept
+	// when other runs are discarded as outliers.
+	Run int
 }
 
 func NewResult() *Result {
-	return &Result{Result: new(regression.Result)}
+	return &Result{
+		Result: new(regression.Result),
+		Status: StatusOK,
+	}
+}
+
+// fail sets the status and error of an unsuccessful run.
+func (r *Result) fail(status Status, err error) *Result {
+	r.Status = status
+	r.Error = err.Error()
+	return r
+}
+
+// status returns the first unsuccessful status of a set of results or ok if
+// all of them succeeded.
+func status(rs []*Result) Status {
+	for _, r := range rs {
+		if r.Status != StatusOK {
+			return r.Status
+		}
+	}
+
+	return StatusOK
+}
+
+// Compare returns the percentage difference between two results. Metrics
+// that did not change have no difference, even when they are 0.
+func (r *Result) Compare(q *Result) Comparison {
+	return Comparison{
+		Comparison: regression.Comparison{
+			Memory: percent(r.Memory, q.Memory),
+			Wtime:  percent(int64(r.Wtime), int64(q.Wtime)),
+			Stime:  percent(int64(r.Stime), int64(q.Stime)),
+			Utime:  percent(int64(r.Utime), int64(q.Utime)),
+		},
+		Rows: percent(r.Rows, q.Rows),
+	}
 }
 
 // ComparePrint shows the difference between two results and returns if
-// it is within margin.
+// it is within margin. The allowance and the metrics that can fail are
+// taken from the query of the second result, allowance is used for the
+// metrics without a specific one.
 func (r *Result) ComparePrint(q *Result, allowance float64) bool {
-	ok := r.Result.ComparePrint(q.Result, allowance)
+	return r.CompareStatsPrint(q, allowance, nil)
+}
+
+// CompareStatsPrint works as ComparePrint but uses the statistical
+// comparisons of the metrics found in stats. Those metrics show the
+// medians and are only over the allowance when the change is also
+// significant. Metrics without enough runs to be significant compare the
+// means.
+func (r *Result) CompareStatsPrint(
+	q *Result,
+	allowance float64,
+	stats map[string]*StatComparison,
+) bool {
+	c := r.Compare(q)
+
+	ok := true
+	compare := func(name, metric string, a, b interface{}, change float64) {
+		within := change <= q.allowance(metric, allowance)
+		if !within && q.fails(metric) {
+			ok = false
+		}
+
+		fmt.Printf(regression.CompareFormat, name, a, b, change, within)
+	}
+
+	compareStat := func(name, metric string, a, b interface{}, change float64, duration bool) {
+		s, found := stats[metric]
+		if !found {
+			compare(name, metric, a, b, change)
+			return
+		}
+
+		// without enough runs no change is significant, the means are
+		// compared as without statistics
+		if s.TooFew {
+			compare(name, metric, a, b, change)
+			printStat(name, s, duration)
+			return
+		}
+
+		within := s.Change <= q.allowance(metric, allowance) || !s.Significant
+		if !within && q.fails(metric) {
+			ok = false
+		}
+
+		medianA, medianB := interface{}(int64(s.A.Median)), interface{}(int64(s.B.Median))
+		if duration {
+			medianA, medianB = time.Duration(s.A.Median), time.Duration(s.B.Median)
+		}
+
+		fmt.Printf(regression.CompareFormat, name, medianA, medianB, s.Change, within)
+		printStat(name, s, duration)
+	}
+
+	compareStat("Memory", MetricMemory, r.Memory, q.Memory, c.Memory, false)
+	compareStat("Wtime", MetricWall, r.Wtime, q.Wtime, c.Wtime, true)
+	compareStat("Stime", MetricSystem, r.Stime, q.Stime, c.Stime, true)
+	compareStat("Utime", MetricUser, r.Utime, q.Utime, c.Utime, true)
+	compare("Rows", MetricRows, r.Rows, q.Rows, c.Rows)
+
+	if r.Startup > 0 || q.Startup > 0 {
+		compare("Startup", MetricStartup, r.Startup, q.Startup,
+			percent(int64(r.Startup), int64(q.Startup)))
+		compare("StartupMemory", MetricStartupMemory, r.StartupMemory, q.StartupMemory,
+			percent(r.StartupMemory, q.StartupMemory))
+	}
+
+	if r.Disk != nil && q.Disk != nil {
+		compare("Disk", MetricDisk, r.Disk.Bytes, q.Disk.Bytes,
+			percent(r.Disk.Bytes, q.Disk.Bytes))
+		compare("DiskFiles", MetricDiskFiles, r.Disk.Files, q.Disk.Files,
+			percent(r.Disk.Files, q.Disk.Files))
+		r.compareIndexesPrint(q, q.allowance(MetricDisk, allowance))
+	}
+
+	return ok
+}
 
-	c := Comparison{
-		Rows: regression.Percent(r.Rows, q.Rows),
+// compareIndexesPrint shows the difference of the disk usage of each index
+// between two results. It is informative, only the total usage fails the
+// comparison.
+func (r *Result) compareIndexesPrint(q *Result, allowance float64) {
+	names := r.Disk.indexNames()
+	for _, n := range q.Disk.indexNames() {
+		if _, ok := r.Disk.Indexes[n]; !ok {
+			names = append(names, n)
+		}
 	}
-	ok = ok && (c.Rows <= allowance)
 
-	fmt.Printf(regression.CompareFormat,
-		"Rows",
-		r.Rows,
-		q.Rows,
-		c.Rows,
-		allowance > c.Rows,
+	for _, n := range names {
+		a, b := new(IndexUsage), new(IndexUsage)
+		if u, ok := r.Disk.Indexes[n]; ok {
+			a = u
+		}
+		if u, ok := q.Disk.Indexes[n]; ok {
+			b = u
+		}
+
+		change := percent(a.Bytes, b.Bytes)
+		fmt.Printf(regression.CompareFormat, "Disk "+n,
+			a.Bytes, b.Bytes, change, change <= allowance)
+		fmt.Printf("Files %s: %d -> %d\n", n, a.Files, b.Files)
+	}
+}
+
+// percent returns the percentage difference between two int64. It is 0
+// when both are equal, even if they are 0.
+func percent(a, b int64) float64 {
+	if a == b {
+		return 0
+	}
+
+	return regression.Percent(a, b)
+}
+
+// CompareTimingsPrint shows the difference of each statement timings
+// between two results. It is informative and does not fail the comparison.
+func (r *Result) CompareTimingsPrint(q *Result, allowance float64) {
+	n := len(r.Timings)
+	if len(q.Timings) < n {
+		n = len(q.Timings)
+	}
+
+	limit := q.allowance(MetricWall, allowance)
+	for i := 0; i < n; i++ {
+		a, b := r.Timings[i], q.Timings[i]
+		for _, m := range []struct {
+			name string
+			a, b time.Duration
+		}{
+			{"Query", a.Query, b.Query},
+			{"FirstRow", a.FirstRow, b.FirstRow},
+			{"Total", a.Total, b.Total},
+		} {
+			change := percent(int64(m.a), int64(m.b))
+			fmt.Printf(regression.CompareFormat,
+				fmt.Sprintf("Statement %d %s", i+1, m.name),
+				m.a,
+				m.b,
+				change,
+				change <= limit,
+			)
+		}
+
+		change := percent(a.Rows, b.Rows)
+		fmt.Printf(regression.CompareFormat,
+			fmt.Sprintf("Statement %d Rows", i+1),
+			a.Rows,
+			b.Rows,
+			change,
+			change <= q.allowance(MetricRows, allowance),
+		)
+	}
+}
+
+// averageTimings returns the mean statement timings of the successful
+// results.
+func averageTimings(rs []*Result) []StatementTiming {
+	var ok []*Result
+	for _, r := range rs {
+		if r.Status == StatusOK {
+			ok = append(ok, r)
+		}
+	}
+
+	if len(ok) == 0 {
+		return nil
+	}
+
+	avg := make([]StatementTiming, len(ok[0].Timings))
+	for _, r := range ok {
+		for i := 0; i < len(avg) && i < len(r.Timings); i++ {
+			avg[i].Query += r.Timings[i].Query
+			avg[i].FirstRow += r.Timings[i].FirstRow
+			avg[i].Total += r.Timings[i].Total
+			avg[i].Rows += r.Timings[i].Rows
+		}
+	}
+
+	n := int64(len(ok))
+	for i := range avg {
+		avg[i].Query /= time.Duration(n)
+		avg[i].FirstRow /= time.Duration(n)
+		avg[i].Total /= time.Duration(n)
+		avg[i].Rows /= n
+	}
+
+	return avg
+}
+
+// averageStartup returns the mean startup time and memory of the results
+// that started a server.
+func averageStartup(rs []*Result) (time.Duration, int64) {
+	var (
+		n       int64
+		startup time.Duration
+		memory  int64
+	)
+
+	for _, r := range rs {
+		if r.Startup > 0 {
+			n++
+			startup += r.Startup
+			memory += r.StartupMemory
+		}
+	}
+
+	if n == 0 {
+		return 0, 0
+	}
+
+	return startup / time.Duration(n), memory / n
+}
+
+// CompareChecksum shows whether two results returned the same rows and
+// returns false when they differ. The order of the rows is only taken into
+// account for ordered queries.
+func (r *Result) CompareChecksum(q *Result) bool {
+	ordered := r.Ordered || q.Ordered
+	ok := r.Checksum.Equal(q.Checksum, ordered)
+
+	fmt.Printf("%s: %v -> %v, %v\n",
+		"Checksum",
+		r.Checksum.Short(ordered),
+		q.Checksum.Short(ordered),
+		ok,
 	)
 
 	return ok
 }
+
+// consistent checks that all the results of a query returned the same rows.
+func consistent(rs []*Result) bool {
+	for _, r := range rs[1:] {
+		if !rs[0].Checksum.Equal(r.Checksum, rs[0].Ordered) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,64 @@
+package gitbase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAverageTimings(t *testing.T) {
+	require := require.New(t)
+
+	result := func(status Status, total time.Duration) *Result {
+		r := NewResult()
+		r.Status = status
+		r.Timings = []StatementTiming{{
+			Query:    total / 4,
+			FirstRow: total / 2,
+			Total:    total,
+			Rows:     10,
+		}}
+		return r
+	}
+
+	// all the successful runs are averaged, warm-up runs are discarded
+	// before
+	avg := averageTimings([]*Result{
+		result(StatusOK, 100*time.Millisecond),
+		result(StatusOK, 20*time.Millisecond),
+		result(StatusError, time.Second),
+		result(StatusOK, 40*time.Millisecond),
+	})
+
+	require.Equal([]StatementTiming{{
+		Query:    13333333 * time.Nanosecond,
+		FirstRow: 26666666 * time.Nanosecond,
+		Total:    53333333 * time.Nanosecond,
+		Rows:     10,
+	}}, avg)
+
+	require.Nil(averageTimings([]*Result{result(StatusTimeout, time.Second)}))
+}
+
+func TestComparePrintUnchangedZero(t *testing.T) {
+	require := require.New(t)
+
+	result := func() *Result {
+		r := NewResult()
+		r.Query = Query{
+			ID:   "query",
+			Fail: []string{MetricWall, MetricUser, MetricSystem, MetricMemory},
+		}
+		r.Wtime = time.Second
+		r.Memory = 1024
+		return r
+	}
+
+	a, b := result(), result()
+	require.Equal(Comparison{}, a.Compare(b))
+	require.True(a.ComparePrint(b, 10))
+
+	b.Utime = time.Millisecond
+	require.False(a.ComparePrint(b, 10))
+}
@@ -0,0 +1,190 @@
+package gitbase
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sample holds the resource counters of the server at a point of a query
+// run.
+type Sample struct {
+	// Time is the time since the statements started.
+	Time  time.Duration
+	Utime time.Duration
+	Stime time.Duration
+	// RSS is the resident memory in bytes.
+	RSS int64
+	// ReadBytes and WriteBytes are the bytes read and written to storage
+	// since the process started.
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+// sampler reads the resource counters of a process at regular intervals
+// until it is stopped or the process exits.
+type sampler struct {
+	pid      int
+	interval time.Duration
+	start    time.Time
+	samples  []Sample
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startSampler starts sampling a process. The first sample is taken
+// immediately.
+func startSampler(pid int, interval time.Duration) *sampler {
+	s := &sampler{
+		pid:      pid,
+		interval: interval,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+func (s *sampler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if !s.sample() {
+			return
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample reads the counters and returns false if the process can not be
+// read anymore.
+func (s *sampler) sample() bool {
+	usage, err := readProcUsage(s.pid)
+	if err != nil {
+		return false
+	}
+
+	sample := Sample{
+		Time:  time.Since(s.start),
+		Utime: usage.Utime,
+		Stime: usage.Stime,
+		RSS:   usage.RSS,
+	}
+
+	// io counters need more permissions, the rest of the sample is
+	// still useful without them
+	if counters, err := readProcIO(s.pid); err == nil {
+		sample.ReadBytes = counters["read_bytes"]
+		sample.WriteBytes = counters["write_bytes"]
+	}
+
+	s.samples = append(s.samples, sample)
+	return true
+}
+
+// Stop takes a last sample and returns all of them.
+func (s *sampler) Stop() []Sample {
+	close(s.stop)
+	<-s.done
+	s.sample()
+
+	return s.samples
+}
+
+// readProcIO returns the values from /proc/<pid>/io.
+func readProcIO(pid int) (map[string]int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		values[strings.TrimSuffix(fields[0], ":")] = v
+	}
+
+	return values, scanner.Err()
+}
+
+// writeSamplesCSV writes the samples of several runs of a query. Times are
+// in seconds and memory in MiB. Runs keep their original number even when
+// some of them were discarded.
+func writeSamplesCSV(w io.Writer, rs []*Result) error {
+	_, err := fmt.Fprintf(w, "Run,Time,Utime,Stime,RSS,ReadBytes,WriteBytes\n")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rs {
+		for _, s := range r.Samples {
+			_, err := fmt.Fprintf(w, "%d,%f,%f,%f,%f,%d,%d\n",
+				r.Run,
+				s.Time.Seconds(),
+				s.Utime.Seconds(),
+				s.Stime.Seconds(),
+				toMiB(s.RSS),
+				s.ReadBytes,
+				s.WriteBytes,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// saveSamplesCSV saves the samples of several runs of a query to a file.
+// Nothing is saved if there are no samples.
+func saveSamplesCSV(path string, rs []*Result) error {
+	found := false
+	for _, r := range rs {
+		if len(r.Samples) > 0 {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := writeSamplesCSV(f, rs); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,47 @@
+package gitbase
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampler(t *testing.T) {
+	require := require.New(t)
+
+	s := startSampler(os.Getpid(), 10*time.Millisecond)
+	time.Sleep(55 * time.Millisecond)
+	samples := s.Stop()
+
+	require.True(len(samples) >= 3, "samples: %d", len(samples))
+	for i, sample := range samples {
+		require.True(sample.RSS > 0)
+		if i > 0 {
+			require.True(sample.Time >= samples[i-1].Time)
+		}
+	}
+}
+
+func TestWriteSamplesCSV(t *testing.T) {
+	require := require.New(t)
+
+	// the second run was discarded as outlier
+	rs := []*Result{
+		{Run: 1, Samples: []Sample{
+			{Time: time.Second, Utime: 500 * time.Millisecond, RSS: 1024 * 1024},
+		}},
+		{Run: 3, Samples: []Sample{
+			{Time: 2 * time.Second, ReadBytes: 10, WriteBytes: 20},
+		}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(writeSamplesCSV(&buf, rs))
+	require.Equal(`Run,Time,Utime,Stime,RSS,ReadBytes,WriteBytes
+1,1.000000,0.500000,0.000000,1.000000,0,0
+3,2.000000,0.000000,0.000000,0.000000,10,20
+`, buf.String())
+}
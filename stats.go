@@ -0,0 +1,374 @@
+package gitbase
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// Statistical tests used to decide if a change is significant.
+const (
+	// TestBootstrap uses a bootstrap confidence interval of the change of
+	// the medians. The change is significant when it does not contain 0.
+	TestBootstrap = "bootstrap"
+	// TestMannWhitney uses the two-sided Mann-Whitney U test.
+	TestMannWhitney = "mann-whitney"
+)
+
+const bootstrapIterations = 2000
+
+// minStatRuns is the minimum number of successful runs of each version
+// needed to consider a change significant.
+const minStatRuns = 3
+
+// maxStatRuns limits the search of the runs needed to reach a
+// significance level.
+const maxStatRuns = 1000
+
+// ErrInvalidSignificance is returned when the significance level is not
+// between 0 and 1.
+var ErrInvalidSignificance = errors.NewKind("invalid significance level %v")
+
+// ErrUnreachableSignificance is returned when no change can be significant
+// with the number of runs.
+var ErrUnreachableSignificance = errors.NewKind(
+	"significance level %v can not be reached by %s with %d runs, at least %d needed")
+
+// Stats summarizes the values of a metric in several runs.
+type Stats struct {
+	N      int
+	Mean   float64
+	Median float64
+	Stddev float64
+}
+
+// summarize computes the statistics of a sample. Stddev is the sample
+// standard deviation.
+func summarize(values []float64) Stats {
+	s := Stats{N: len(values)}
+	if s.N == 0 {
+		return s
+	}
+
+	for _, v := range values {
+		s.Mean += v
+	}
+	s.Mean /= float64(s.N)
+
+	if s.N > 1 {
+		var sum float64
+		for _, v := range values {
+			sum += (v - s.Mean) * (v - s.Mean)
+		}
+		s.Stddev = math.Sqrt(sum / float64(s.N-1))
+	}
+
+	s.Median = median(values)
+	return s
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	m := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[m-1] + sorted[m]) / 2
+	}
+
+	return sorted[m]
+}
+
+// percentChange returns the change from a to b in percent. It is 0 when
+// both are equal, even if they are 0.
+func percentChange(a, b float64) float64 {
+	if a == b {
+		return 0
+	}
+
+	return (b - a) / a * 100
+}
+
+// StatComparison holds the statistical comparison of a metric between the
+// runs of two versions.
+type StatComparison struct {
+	A, B Stats
+	// Change is the percentage change of the medians.
+	Change float64
+	// Low and High are the bootstrap confidence interval of Change.
+	Low, High float64
+	// P is the p-value of the Mann-Whitney U test.
+	P float64
+	// Significant is true when the change is significant using the
+	// selected test.
+	Significant bool
+	// TooFew is true when the versions do not have enough runs for any
+	// change to be significant, see canBeSignificant. The means are then
+	// compared using the allowance.
+	TooFew bool
+}
+
+// compareSamples compares the values of a metric of two versions.
+func compareSamples(a, b []float64, significance float64, test string) *StatComparison {
+	c := &StatComparison{
+		A: summarize(a),
+		B: summarize(b),
+	}
+
+	c.Change = percentChange(c.A.Median, c.B.Median)
+	c.Low, c.High = bootstrapCI(a, b, 1-significance)
+	c.P = mannWhitneyU(a, b)
+	c.TooFew = !canBeSignificant(len(a), len(b), significance, test)
+
+	switch {
+	case c.TooFew:
+		c.Significant = false
+	case test == TestMannWhitney:
+		c.Significant = c.P < significance
+	default:
+		c.Significant = c.Low > 0 || c.High < 0
+	}
+
+	return c
+}
+
+// canBeSignificant returns if a change between samples of sizes n1 and n2
+// can be significant. Both need at least minStatRuns values and, with
+// Mann-Whitney U, completely separated samples must reach the
+// significance level.
+func canBeSignificant(n1, n2 int, significance float64, test string) bool {
+	if n1 < minStatRuns || n2 < minStatRuns {
+		return false
+	}
+
+	if test != TestMannWhitney {
+		return true
+	}
+
+	a := make([]float64, n1)
+	b := make([]float64, n2)
+	for i := range a {
+		a[i] = float64(i)
+	}
+	for i := range b {
+		b[i] = float64(n1 + i)
+	}
+
+	return mannWhitneyU(a, b) < significance
+}
+
+// minRuns returns the runs of each version needed for a change to be
+// significant or 0 if it is over maxStatRuns.
+func minRuns(significance float64, test string) int {
+	for n := minStatRuns; n <= maxStatRuns; n++ {
+		if canBeSignificant(n, n, significance, test) {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// validSignificance checks that changes can be significant with the given
+// runs of each version.
+func validSignificance(significance float64, test string, runs int) error {
+	if significance <= 0 || canBeSignificant(runs, runs, significance, test) {
+		return nil
+	}
+
+	return ErrUnreachableSignificance.New(
+		significance, test, runs, minRuns(significance, test))
+}
+
+// bootstrapCI returns the confidence interval of the percentage change of
+// the medians of two samples. A fixed seed is used so the same samples give
+// the same interval.
+func bootstrapCI(a, b []float64, confidence float64) (float64, float64) {
+	if len(a) == 0 || len(b) == 0 {
+		return math.Inf(-1), math.Inf(1)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	resample := func(values, into []float64) float64 {
+		for i := range into {
+			into[i] = values[random.Intn(len(values))]
+		}
+
+		return median(into)
+	}
+
+	bufA := make([]float64, len(a))
+	bufB := make([]float64, len(b))
+	changes := make([]float64, bootstrapIterations)
+	for i := range changes {
+		changes[i] = percentChange(resample(a, bufA), resample(b, bufB))
+	}
+
+	return interval(changes, confidence)
+}
+
+// medianCI returns the bootstrap confidence interval of the median of a
+// sample.
+func medianCI(values []float64, confidence float64) (float64, float64) {
+	if len(values) == 0 {
+		return math.Inf(-1), math.Inf(1)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	buf := make([]float64, len(values))
+	medians := make([]float64, bootstrapIterations)
+	for i := range medians {
+		for j := range buf {
+			buf[j] = values[random.Intn(len(values))]
+		}
+
+		medians[i] = median(buf)
+	}
+
+	return interval(medians, confidence)
+}
+
+// interval returns the limits of the central confidence interval of the
+// bootstrap values. The values are sorted in place.
+func interval(values []float64, confidence float64) (float64, float64) {
+	sort.Float64s(values)
+
+	alpha := (1 - confidence) / 2
+	low := values[int(math.Floor(alpha*float64(len(values)-1)))]
+	high := values[int(math.Ceil((1-alpha)*float64(len(values)-1)))]
+
+	return low, high
+}
+
+// mannWhitneyU returns the two-sided p-value of the Mann-Whitney U test
+// using the normal approximation with tie correction.
+func mannWhitneyU(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	type value struct {
+		v     float64
+		first bool
+	}
+
+	values := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		values = append(values, value{v, true})
+	}
+	for _, v := range b {
+		values = append(values, value{v, false})
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].v < values[j].v
+	})
+
+	// ranks of tied values are the mean of their positions
+	var rankSum, ties float64
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].v == values[i].v {
+			j++
+		}
+
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if values[k].first {
+				rankSum += rank
+			}
+		}
+
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n := n1 + n2
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1
+	}
+
+	z := (math.Abs(u-mean) - 0.5) / sigma
+	if z < 0 {
+		z = 0
+	}
+
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// metricValues returns the values of a metric of the successful runs.
+func metricValues(rs []*Result, metric string) []float64 {
+	var values []float64
+	for _, r := range rs {
+		if r.Status != StatusOK {
+			continue
+		}
+
+		var v float64
+		switch metric {
+		case MetricWall:
+			v = float64(r.Wtime)
+		case MetricUser:
+			v = float64(r.Utime)
+		case MetricSystem:
+			v = float64(r.Stime)
+		case MetricMemory:
+			v = float64(r.Memory)
+		}
+
+		values = append(values, v)
+	}
+
+	return values
+}
+
+// statMetrics are the metrics compared statistically.
+var statMetrics = []string{MetricWall, MetricUser, MetricSystem, MetricMemory}
+
+// compareRuns compares statistically the resource metrics of the runs of
+// two versions.
+func compareRuns(a, b []*Result, significance float64, test string) map[string]*StatComparison {
+	stats := make(map[string]*StatComparison, len(statMetrics))
+	for _, m := range statMetrics {
+		stats[m] = compareSamples(
+			metricValues(a, m), metricValues(b, m), significance, test)
+	}
+
+	return stats
+}
+
+// printStat shows the details of a statistical comparison. Time metrics
+// are shown as durations.
+func printStat(name string, c *StatComparison, duration bool) {
+	format := func(v float64) interface{} {
+		if duration {
+			return time.Duration(v)
+		}
+
+		return int64(v)
+	}
+
+	if c.TooFew {
+		fmt.Printf("# Warning - %s: not enough runs for a significant change (%d -> %d), means compared\n",
+			name, c.A.N, c.B.N)
+	}
+
+	fmt.Printf("%s stats: mean %v -> %v, stddev %v -> %v, ci [%.2f, %.2f], p %.3f, significant %v\n",
+		name,
+		format(c.A.Mean), format(c.B.Mean),
+		format(c.A.Stddev), format(c.B.Stddev),
+		c.Low, c.High, c.P, c.Significant)
+}
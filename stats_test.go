@@ -0,0 +1,150 @@
+package gitbase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	require := require.New(t)
+
+	s := summarize([]float64{4, 1, 3, 2})
+	require.Equal(4, s.N)
+	require.Equal(2.5, s.Mean)
+	require.Equal(2.5, s.Median)
+	require.InDelta(1.291, s.Stddev, 0.001)
+
+	require.Equal(3.0, median([]float64{5, 1, 3}))
+	require.Equal(Stats{}, summarize(nil))
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	require := require.New(t)
+
+	a := []float64{1, 2, 3, 4, 5}
+	b := []float64{6, 7, 8, 9, 10}
+	require.InDelta(0.0122, mannWhitneyU(a, b), 0.0001)
+	require.InDelta(0.0122, mannWhitneyU(b, a), 0.0001)
+
+	require.Equal(1.0, mannWhitneyU(a, a[:0]))
+	require.Equal(1.0, mannWhitneyU([]float64{1, 1}, []float64{1, 1}))
+	require.True(mannWhitneyU(a, []float64{1, 2, 3, 4, 6}) > 0.5)
+}
+
+func TestBootstrapCI(t *testing.T) {
+	require := require.New(t)
+
+	a := []float64{100, 101, 99, 100, 102, 98}
+	b := []float64{150, 151, 149, 150, 152, 148}
+
+	low, high := bootstrapCI(a, b, 0.95)
+	require.True(low > 40 && high < 60, "ci: [%v, %v]", low, high)
+
+	low, high = bootstrapCI(a, a, 0.95)
+	require.True(low <= 0 && high >= 0, "ci: [%v, %v]", low, high)
+}
+
+func TestCompareStatsPrint(t *testing.T) {
+	require := require.New(t)
+
+	runs := func(walls ...time.Duration) []*Result {
+		var rs []*Result
+		for _, w := range walls {
+			r := NewResult()
+			r.Wtime = w
+			r.Memory = 100
+			rs = append(rs, r)
+		}
+		return rs
+	}
+
+	stable := runs(100, 101, 99, 100, 100, 101, 99, 100)
+	slower := runs(150, 151, 149, 150, 150, 151, 149, 150)
+	noisy := runs(100, 300, 60, 200, 90, 130, 70, 250)
+
+	for _, test := range []string{TestBootstrap, TestMannWhitney} {
+		a, b := NewResult(), NewResult()
+		stats := compareRuns(stable, slower, 0.05, test)
+		require.True(stats[MetricWall].Significant, test)
+		require.False(a.CompareStatsPrint(b, 10, stats), test)
+
+		stats = compareRuns(stable, noisy, 0.05, test)
+		require.False(stats[MetricWall].Significant, test)
+		require.True(stats[MetricWall].Change > 10, test)
+		require.True(a.CompareStatsPrint(b, 10, stats), test)
+	}
+}
+
+func TestCompareSamplesTooFew(t *testing.T) {
+	require := require.New(t)
+
+	for _, test := range []string{TestBootstrap, TestMannWhitney} {
+		c := compareSamples([]float64{100}, []float64{112}, 0.05, test)
+		require.True(c.TooFew, test)
+		require.False(c.Significant, test)
+		require.Equal(12.0, c.Change, test)
+
+		c = compareSamples([]float64{100, 101}, []float64{150, 151, 149}, 0.05, test)
+		require.True(c.TooFew, test)
+		require.False(c.Significant, test)
+	}
+
+	c := compareSamples(
+		[]float64{100, 101, 99}, []float64{150, 151, 149}, 0.05, TestBootstrap)
+	require.False(c.TooFew)
+	require.True(c.Significant)
+}
+
+func TestCompareStatsPrintTooFew(t *testing.T) {
+	require := require.New(t)
+
+	runs := func(walls ...time.Duration) []*Result {
+		var rs []*Result
+		for _, w := range walls {
+			r := NewResult()
+			r.Wtime = w
+			r.Memory = 100
+			rs = append(rs, r)
+		}
+		return rs
+	}
+
+	// with too few runs the means are compared with the allowance
+	for _, test := range []string{TestBootstrap, TestMannWhitney} {
+		a, b := runs(time.Second, time.Second), runs(5*time.Second, 5*time.Second)
+		stats := compareRuns(a, b, 0.05, test)
+		require.True(stats[MetricWall].TooFew, test)
+
+		ra, rb := NewResult(), NewResult()
+		ra.Result, rb.Result = average(a), average(b)
+		require.False(ra.CompareStatsPrint(rb, 10, stats), test)
+
+		rb.Result = average(runs(time.Second, 1050*time.Millisecond))
+		require.True(ra.CompareStatsPrint(rb, 10, stats), test)
+	}
+}
+
+func TestCanBeSignificant(t *testing.T) {
+	require := require.New(t)
+
+	require.False(canBeSignificant(2, 10, 0.05, TestBootstrap))
+	require.True(canBeSignificant(3, 3, 0.05, TestBootstrap))
+
+	// separated samples of 3 runs only reach p 0.081
+	require.False(canBeSignificant(3, 3, 0.05, TestMannWhitney))
+	require.True(canBeSignificant(4, 4, 0.05, TestMannWhitney))
+	require.True(canBeSignificant(3, 3, 0.1, TestMannWhitney))
+
+	require.Equal(3, minRuns(0.05, TestBootstrap))
+	require.Equal(4, minRuns(0.05, TestMannWhitney))
+
+	require.NoError(validSignificance(0, TestMannWhitney, 1))
+	require.NoError(validSignificance(0.05, TestBootstrap, 3))
+	require.NoError(validSignificance(0.05, TestMannWhitney, 4))
+	require.True(ErrUnreachableSignificance.Is(
+		validSignificance(0.05, TestMannWhitney, 3)))
+	require.True(ErrUnreachableSignificance.Is(
+		validSignificance(0.05, TestBootstrap, 2)))
+}
@@ -3,10 +3,16 @@ package gitbase
 import (
 	"context"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/src-d/regression-core"
 	"gopkg.in/src-d/go-log.v1"
 )
@@ -19,16 +25,51 @@ type (
 	Test struct {
 		config    regression.Config
 		repos     *regression.Repositories
-		testRepos string
-		gitbase   map[string]*regression.Binary
-		results   versionResults
-		queries   []Query
-		log       log.Logger
+		testRepos []RepoRoot
+		// extraRoots are repository roots served with the test
+		// repositories
+		extraRoots []RepoRoot
+		gitbase    map[string]*regression.Binary
+		semvers    map[string]*semver.Version
+		// builds has the build dates of the versions, zero when unknown
+		builds  map[string]time.Time
+		results versionResults
+		// loadResults has the concurrent load mode results per version
+		loadResults map[string]*LoadResult
+		// discarded has the warm-up and outlier runs per version and
+		// query
+		discarded map[string]map[string][]Discarded
+		// profiles has the profiles captured per version and query
+		profiles map[string]map[string]*Profiles
+		// indexes and indexResults have the index suite definitions and
+		// results per version and index
+		indexes      []Index
+		indexResults map[string]map[string][]*IndexResult
+		catalogs     map[string][]Query
+		// cpus has the processors assigned to each binary in parallel
+		// mode
+		cpus map[*regression.Binary][]int
+		// args has the extra server arguments of each binary
+		args map[*regression.Binary][]string
+		// startErrors has the errors of the binaries whose servers never
+		// became ready, they are not started again
+		startErrors map[*regression.Binary]error
+		// fileArgs has the extra server arguments from the per version
+		// arguments file
+		fileArgs map[string][]string
+		options  Options
+		filter   *Filter
+		log      log.Logger
+		mu       sync.Mutex
 	}
 )
 
 // NewTest creates a new Test struct.
-func NewTest(config regression.Config, serverConfig regression.GitServerConfig) (*Test, error) {
+func NewTest(
+	config regression.Config,
+	serverConfig regression.GitServerConfig,
+	options Options,
+) (*Test, error) {
 	repos, err := regression.NewRepositories(serverConfig)
 	if err != nil {
 		return nil, err
@@ -39,11 +80,59 @@ func NewTest(config regression.Config, serverConfig regression.GitServerConfig)
 		return nil, err
 	}
 
+	filter, err := NewFilter(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Significance < 0 || options.Significance >= 1 {
+		return nil, ErrInvalidSignificance.New(options.Significance)
+	}
+
+	if err := validSignificance(options.Significance, options.StatsTest, config.Repeat); err != nil {
+		return nil, err
+	}
+
+	if options.Profile && options.ProfileFlag == "" {
+		return nil, ErrProfileFlag.New()
+	}
+
+	if err := validAdaptive(options, config.Repeat); err != nil {
+		return nil, err
+	}
+
+	if err := validOutliers(options.Outliers); err != nil {
+		return nil, err
+	}
+
+	if err := validRepoFormat(options.ReposFormat); err != nil {
+		return nil, err
+	}
+
+	fileArgs, err := loadVersionArgs(options.GitbaseArgsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []RepoRoot
+	for _, r := range options.ReposRoots {
+		root, err := parseRepoRoot(r)
+		if err != nil {
+			return nil, err
+		}
+
+		roots = append(roots, root)
+	}
+
 	return &Test{
-		config:  config,
-		repos:   repos,
-		queries: nil,
-		log:     l,
+		config:     config,
+		repos:      repos,
+		catalogs:   make(map[string][]Query),
+		fileArgs:   fileArgs,
+		extraRoots: roots,
+		options:    options,
+		filter:     filter,
+		log:        l,
 	}, nil
 }
 
@@ -77,63 +166,258 @@ func (t *Test) RunQueryCtx(ctx context.Context, gitbaseEnvs map[string]string, q
 	return nil
 }
 
-// RunLoad executes the tests.
+// RunLoad executes the tests. With the parallel option all the versions
+// run at the same time, each one with its servers pinned to a different
+// set of processors.
 func (t *Test) RunLoad() error {
 	results := make(versionResults)
 
-	for _, version := range t.config.Versions {
-		_, ok := results[version]
-		if !ok {
-			results[version] = make(gitbaseResults)
+	if !t.options.Parallel {
+		for _, version := range t.config.Versions {
+			r, err := t.runVersion(version)
+			if err != nil {
+				return err
+			}
+
+			results[version] = r
 		}
 
-		gitbase, ok := t.gitbase[version]
-		if !ok {
-			panic("gitbase not initialized. Was Prepare called?")
+		t.results = results
+		return nil
+	}
+
+	cpus, err := t.pinCPUs()
+	if err != nil {
+		return err
+	}
+	t.cpus = cpus
+
+	errs := make([]error, len(t.config.Versions))
+	partial := make([]gitbaseResults, len(t.config.Versions))
+
+	var wg sync.WaitGroup
+	for i, version := range t.config.Versions {
+		wg.Add(1)
+		go func(i int, version string) {
+			defer wg.Done()
+			partial[i], errs[i] = t.runVersion(version)
+		}(i, version)
+	}
+	wg.Wait()
+
+	for i, version := range t.config.Versions {
+		if errs[i] != nil {
+			return errs[i]
 		}
 
-		l := t.log.New(log.Fields{"version": version})
+		results[version] = partial[i]
+	}
+
+	t.results = results
+
+	return nil
+}
+
+// runVersion executes the tests of one version.
+func (t *Test) runVersion(version string) (gitbaseResults, error) {
+	results := make(gitbaseResults)
+
+	gitbase, ok := t.gitbase[version]
+	if !ok {
+		panic("gitbase not initialized. Was Prepare called?")
+	}
+
+	l := t.log.New(log.Fields{"version": version})
 
-		l.Infof("Running version tests")
+	l.Infof("Running version tests")
 
-		times := t.config.Repeat
-		if times < 1 {
-			times = 1
+	times := t.config.Repeat
+	if times < 1 {
+		times = 1
+	}
+
+	queries, err := t.loadQueries(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var warm *warmServer
+	if t.options.Warm {
+		warm = &warmServer{
+			test:    t,
+			gitbase: gitbase,
+			repos:   t.testRepos,
 		}
+	}
 
-		rf := gitbase.ExtraFile("regression.yml")
-		if queries, err := loadQueriesYaml(rf); err != nil {
-			return err
-		} else {
-			t.queries = queries
+	for _, query := range queries {
+		if !query.applies(t.semvers[version], t.builds[version]) {
+			l.With(log.Fields{
+				"query.ID":   query.ID,
+				"query.Name": query.Name,
+			}).Infof("Query not applicable")
+
+			result := NewResult()
+			result.Query = query
+			result.Status = StatusNotApplicable
+			results[query.ID] = []*Result{result}
+			continue
 		}
 
-		for _, query := range t.queries {
-			results[version][query.ID] = make([]*Result, times)
+		if err := t.startError(gitbase); err != nil {
+			l.With(log.Fields{
+				"query.ID":   query.ID,
+				"query.Name": query.Name,
+			}).Errorf(err, "Query not run, the server could not start")
 
-			for i := 0; i < times; i++ {
-				l.New(log.Fields{
-					"query.ID":   query.ID,
-					"query.Name": query.Name,
-				}).Infof("Running query")
+			result := NewResult()
+			result.Query = query
+			results[query.ID] = []*Result{result.fail(StatusError, err)}
+			continue
+		}
 
-				result, err := t.runLoadTest(gitbase, t.testRepos, query)
-				results[version][query.ID][i] = result
+		results[query.ID] = make([]*Result, 0, times)
+		discarded := t.warmup(warm, gitbase, query)
 
-				// TODO: do not stop on errors ???
-				if err != nil {
-					return err
-				}
+		ql := l.New(log.Fields{
+			"query.ID":   query.ID,
+			"query.Name": query.Name,
+		})
+
+		start := time.Now()
+		for i := 0; t.repeat(ql, results[query.ID], times, start); i++ {
+			ql.Infof("Running query")
+
+			capture := 0
+			if i == 0 {
+				capture = t.options.diffRows()
+			}
+
+			var result *Result
+			if warm != nil {
+				result, err = warm.run(query, capture)
+			} else {
+				result, err = t.runLoadTest(gitbase, t.testRepos, query, capture)
+			}
+			result.Run = i + 1
+			results[query.ID] = append(results[query.ID], result)
+
+			// do not repeat failed queries, the result already
+			// holds the failure
+			if err != nil {
+				ql.With(log.Fields{
+					"status": result.Status,
+				}).Errorf(err, "Query failed")
+				break
 			}
 		}
+
+		kept, outliers := removeOutliers(results[query.ID], t.options.Outliers)
+		results[query.ID] = kept
+		t.discard(version, query.ID, append(discarded, outliers...))
+
+		if t.options.Profile && status(results[query.ID]) == StatusOK {
+			t.profile(version, gitbase, query, results[query.ID])
+		}
 	}
 
-	t.results = results
+	if warm != nil {
+		warm.stop()
+	}
 
-	return nil
+	return results, nil
+}
+
+// warmup runs a query the configured number of times before measuring it.
+// The runs are returned to be reported as discarded.
+func (t *Test) warmup(warm *warmServer, gitbase *regression.Binary, query Query) []Discarded {
+	var discarded []Discarded
+	for i := 0; i < t.options.Warmup; i++ {
+		l := t.log.With(log.Fields{
+			"query.ID": query.ID,
+			"run":      i + 1,
+		})
+		l.Infof("Running warm-up query")
+
+		var (
+			result *Result
+			err    error
+		)
+		if warm != nil {
+			result, err = warm.warmup(query)
+		} else {
+			result, err = t.runLoadTest(gitbase, t.testRepos, query, 0)
+		}
+
+		if err != nil {
+			l.Errorf(err, "Warm-up query failed")
+		}
+
+		discarded = append(discarded, Discarded{
+			Run:    i + 1,
+			Reason: DiscardWarmup,
+			Result: result,
+		})
+
+		if t.startError(gitbase) != nil {
+			break
+		}
+	}
+
+	return discarded
+}
+
+// discard saves the runs of a query not used in the comparison.
+func (t *Test) discard(version, id string, ds []Discarded) {
+	if len(ds) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.discarded == nil {
+		t.discarded = make(map[string]map[string][]Discarded)
+	}
+	if t.discarded[version] == nil {
+		t.discarded[version] = make(map[string][]Discarded)
+	}
+
+	t.discarded[version][id] = ds
+}
+
+// profile captures the profiles of a query and saves them in the test.
+// Failures are logged and the query is left without profiles.
+func (t *Test) profile(
+	version string,
+	gitbase *regression.Binary,
+	query Query,
+	results []*Result,
+) {
+	profiles, err := t.profileQuery(version, gitbase, query, results)
+	if err != nil {
+		t.log.With(log.Fields{
+			"version":  version,
+			"query.ID": query.ID,
+		}).Errorf(err, "Could not capture profiles")
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.profiles == nil {
+		t.profiles = make(map[string]map[string]*Profiles)
+	}
+	if t.profiles[version] == nil {
+		t.profiles[version] = make(map[string]*Profiles)
+	}
+
+	t.profiles[version][query.ID] = profiles
 }
 
 func (t *Test) PrintTabbedResults() {
+	fmt.Printf("Filter: %s\n", t.filter)
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 0, ' ', tabwriter.TabIndent|tabwriter.Debug)
 	fmt.Fprint(w, "\x1b[1;33m ID \x1b[0m")
 	versions := t.config.Versions
@@ -142,46 +426,45 @@ func (t *Test) PrintTabbedResults() {
 	}
 	fmt.Fprintf(w, "\n")
 
-	for _, q := range t.queries {
+	for _, q := range t.queries(versions...) {
 		fmt.Fprintf(w, "\x1b[1;37m %s \x1b[0m", q.ID)
 		var (
-			mini    int
+			mini    = -1
 			min     time.Duration
-			maxi    int
+			maxi    = -1
 			max     time.Duration
 			results []string
 		)
 		for i, v := range versions {
-			if r, found := t.results[v][q.ID]; !found {
+			r, found := t.results[v][q.ID]
+			if !found {
 				results = append(results, "--")
-			} else {
-				t := r[0].Wtime
-				for _, ri := range r[1:] {
-					if ri.Wtime < min {
-						t = ri.Wtime
-					}
-				}
-
-				if min == 0 {
-					min = t
-				}
+				continue
+			}
 
-				if max == 0 {
-					max = t
-				}
+			if s := status(r); s != StatusOK {
+				results = append(results, strings.ToUpper(string(s)))
+				continue
+			}
 
-				if t < min {
-					min = t
-					mini = i
+			t := r[0].Wtime
+			for _, ri := range r[1:] {
+				if ri.Wtime < t {
+					t = ri.Wtime
 				}
+			}
 
-				if t > max {
-					max = t
-					maxi = i
-				}
+			if mini < 0 || t < min {
+				min = t
+				mini = i
+			}
 
-				results = append(results, t.String())
+			if maxi < 0 || t > max {
+				max = t
+				maxi = i
 			}
+
+			results = append(results, t.String())
 		}
 
 		for i, r := range results {
@@ -200,36 +483,78 @@ func (t *Test) PrintTabbedResults() {
 	fmt.Println()
 }
 
+// average returns the mean resources of the successful results. Unlike
+// regression.Average no run is discarded, warm-up runs and outliers are
+// already removed.
 func average(pr []*Result) *regression.Result {
-	if len(pr) == 0 {
+	var results []*regression.Result
+	for _, r := range pr {
+		if r.Status == StatusOK {
+			results = append(results, r.Result)
+		}
+	}
+
+	if len(results) == 0 {
 		return nil
 	}
 
-	results := make([]*regression.Result, 0, len(pr))
-	for _, r := range pr {
-		results = append(results, r.Result)
+	agg := new(regression.Result)
+	for _, r := range results {
+		agg.Memory += r.Memory
+		agg.Wtime += r.Wtime
+		agg.Stime += r.Stime
+		agg.Utime += r.Utime
 	}
 
-	return regression.Average(results)
+	n := float64(len(results))
+	agg.Memory = int64(math.Round(float64(agg.Memory) / n))
+	agg.Wtime = time.Duration(math.Round(float64(agg.Wtime) / n))
+	agg.Stime = time.Duration(math.Round(float64(agg.Stime) / n))
+	agg.Utime = time.Duration(math.Round(float64(agg.Utime) / n))
+
+	return agg
 }
 
 func (t *Test) SaveLatestCSV() {
 	version := t.config.Versions[len(t.config.Versions)-1]
-	for _, q := range t.queries {
+	for _, q := range t.catalogs[version] {
 		res := average(t.results[version][q.ID])
+		if res == nil {
+			continue
+		}
+
 		if err := res.SaveAllCSV(fmt.Sprintf("plot_%s_", q.ID)); err != nil {
 			panic(err)
 		}
+
+		path := fmt.Sprintf("plot_%s_samples.csv", q.ID)
+		if err := saveSamplesCSV(path, t.results[version][q.ID]); err != nil {
+			panic(err)
+		}
 	}
 }
 
 // StoreLatestToPrometheus stores latest version results to prometheus pushgateway
 func (t *Test) StoreLatestToPrometheus(promConfig regression.PromConfig, ciConfig regression.CIConfig) error {
 	version := t.config.Versions[len(t.config.Versions)-1]
-	cli := NewPromClient(promConfig)
-	for _, q := range t.queries {
-		res := average(t.results[version][q.ID])
-		if err := cli.Dump(res, version, q.ID, ciConfig.Branch, ciConfig.Commit); err != nil {
+	var filter string
+	if t.filter.Active() {
+		filter = t.filter.String()
+	}
+
+	cli := NewPromClient(promConfig, filter)
+	for _, q := range t.catalogs[version] {
+		rs := t.results[version][q.ID]
+		avg := average(rs)
+		if avg == nil {
+			continue
+		}
+
+		res := *rs[0]
+		res.Result = avg
+		res.Disk = averageDisk(rs)
+
+		if err := cli.Dump(&res, version, q.ID, ciConfig.Branch, ciConfig.Commit); err != nil {
 			return err
 		}
 	}
@@ -242,6 +567,8 @@ func (t *Test) GetResults() bool {
 		panic("there should be at least one version")
 	}
 
+	fmt.Printf("Filter: %s\n", t.filter)
+
 	versions := t.config.Versions
 	ok := true
 	for i, version := range versions[0 : len(versions)-1] {
@@ -249,8 +576,29 @@ func (t *Test) GetResults() bool {
 		a := t.results[versions[i]]
 		b := t.results[versions[i+1]]
 
-		for _, query := range t.queries {
+		catalogA := t.catalogs[versions[i]]
+		catalogB := t.catalogs[versions[i+1]]
+		changes := compareCatalogs(catalogA, catalogB)
+		t.printArgs(versions[i], versions[i+1])
+		fmt.Printf("# Catalog - added: %d, removed: %d, changed: %d\n",
+			len(changes.Added), len(changes.Removed), len(changes.Changed))
+
+		for _, query := range unionQueries(catalogA, catalogB) {
 			fmt.Printf("## Query {ID: %s, Name: %s} ##\n", query.ID, query.Name)
+			switch {
+			case contains(changes.Added, query.ID):
+				fmt.Printf("# Added - Query.ID: %s only in version: %s\n", query.ID, versions[i+1])
+				continue
+			case contains(changes.Removed, query.ID):
+				fmt.Printf("# Removed - Query.ID: %s only in version: %s\n", query.ID, versions[i])
+				continue
+			}
+
+			changed := contains(changes.Changed, query.ID)
+			if changed {
+				fmt.Printf("# Changed - Query.ID: %s has different statements in versions: %s, %s\n", query.ID, versions[i], versions[i+1])
+			}
+
 			if _, found := a[query.ID]; !found {
 				fmt.Printf("# Skip - Query.ID: %s not found for version: %s\n", query.ID, versions[i])
 				continue
@@ -260,35 +608,208 @@ func (t *Test) GetResults() bool {
 				continue
 			}
 
-			queryA := a[query.ID][0]
-			queryB := b[query.ID][0]
+			statusA := status(a[query.ID])
+			statusB := status(b[query.ID])
+			if statusA == StatusNotApplicable || statusB == StatusNotApplicable {
+				fmt.Printf("# Skip - Query.ID: %s not applicable: %s -> %s\n", query.ID, statusA, statusB)
+				continue
+			}
+
+			// only failures of the new version fail the run, a query
+			// that failed before and succeeds now is informative
+			if statusA != StatusOK || statusB != StatusOK {
+				fmt.Printf("Status: %s -> %s, %v\n", statusA, statusB, statusB == StatusOK)
+				printErrors(a[query.ID], versions[i])
+				printErrors(b[query.ID], versions[i+1])
+				if statusB != StatusOK {
+					ok = false
+				}
+				continue
+			}
+
+			printTeardownErrors(a[query.ID], versions[i])
+			printTeardownErrors(b[query.ID], versions[i+1])
+			printDiscarded(t.discarded[versions[i]][query.ID], versions[i])
+			printDiscarded(t.discarded[versions[i+1]][query.ID], versions[i+1])
+
+			if !consistent(a[query.ID]) {
+				fmt.Printf("# Warning - Query.ID: %s returns different rows between runs for version: %s\n", query.ID, versions[i])
+			}
+			if !consistent(b[query.ID]) {
+				fmt.Printf("# Warning - Query.ID: %s returns different rows between runs for version: %s\n", query.ID, versions[i+1])
+			}
+
+			// copies so the stored results are not modified
+			queryA := *a[query.ID][0]
+			queryB := *b[query.ID][0]
 
 			queryA.Result = average(a[query.ID])
 			queryB.Result = average(b[query.ID])
-			c := queryA.ComparePrint(queryB, 10.0)
+			queryA.Startup, queryA.StartupMemory = averageStartup(a[query.ID])
+			queryB.Startup, queryB.StartupMemory = averageStartup(b[query.ID])
+			queryA.Disk = averageDisk(a[query.ID])
+			queryB.Disk = averageDisk(b[query.ID])
+			var stats map[string]*StatComparison
+			if t.options.Significance > 0 {
+				stats = compareRuns(a[query.ID], b[query.ID],
+					t.options.Significance, t.options.StatsTest)
+			}
+
+			c := queryA.CompareStatsPrint(&queryB, t.options.allowance(), stats)
 			if !c {
 				ok = false
 			}
+
+			queryA.Timings = averageTimings(a[query.ID])
+			queryB.Timings = averageTimings(b[query.ID])
+			queryA.CompareTimingsPrint(&queryB, t.options.allowance())
+
+			if t.options.Profile {
+				t.printProfileDiff(versions[i], versions[i+1], query.ID)
+			}
+
+			if !queryA.CompareChecksum(&queryB) {
+				if changed {
+					fmt.Printf("# Warning - Query.ID: %s returns different rows but its statements changed\n", query.ID)
+				} else {
+					fmt.Printf("# Correctness failure - Query.ID: %s returns different rows\n", query.ID)
+					ok = false
+				}
+			}
+
+			if t.options.Diff {
+				if err := t.printDiff(versions[i], versions[i+1], &queryA, &queryB); err != nil {
+					t.log.Errorf(err, "Could not save diff")
+				}
+			}
 		}
 	}
 
 	return ok
 }
 
+// loadQueries reads the catalog of a version and applies the filter. The
+// selected queries are saved as the version catalog.
+func (t *Test) loadQueries(version string) ([]Query, error) {
+	gitbase, ok := t.gitbase[version]
+	if !ok {
+		panic("gitbase not initialized. Was Prepare called?")
+	}
+
+	l := t.log.New(log.Fields{"version": version})
+	rf := gitbase.ExtraFile("regression.yml")
+	queries, err := loadCatalog(l, rf, t.options.Queries, t.options.ReplaceQueries)
+	if err != nil {
+		return nil, err
+	}
+
+	queries = t.filter.Apply(queries)
+	t.mu.Lock()
+	t.catalogs[version] = queries
+	t.mu.Unlock()
+
+	return queries, nil
+}
+
+// queries returns the union of the queries run by the given versions.
+func (t *Test) queries(versions ...string) []Query {
+	catalogs := make([][]Query, 0, len(versions))
+	for _, v := range versions {
+		catalogs = append(catalogs, t.catalogs[v])
+	}
+
+	return unionQueries(catalogs...)
+}
+
+// printErrors shows the errors of the failed runs of a query.
+func printErrors(rs []*Result, version string) {
+	for _, r := range rs {
+		if r.Status != StatusOK {
+			fmt.Printf("# %s - Query.ID: %s version: %s: %s\n",
+				strings.Title(string(r.Status)), r.ID, version, r.Error)
+		}
+	}
+}
+
+// printTeardownErrors shows the errors of the teardown statements of a
+// query. They do not fail the comparison.
+func printTeardownErrors(rs []*Result, version string) {
+	for _, r := range rs {
+		if r.TeardownError != "" {
+			fmt.Printf("# Teardown error - Query.ID: %s version: %s: %s\n",
+				r.ID, version, r.TeardownError)
+		}
+	}
+}
+
+// printDiff shows the row differences between two results and saves them to
+// the diff directory if it is configured.
+func (t *Test) printDiff(versionA, versionB string, a, b *Result) error {
+	diffs := diffOutputs(a.Tables, b.Tables, b.Key)
+
+	empty := true
+	for _, d := range diffs {
+		if !d.Empty() {
+			empty = false
+			break
+		}
+	}
+
+	if empty {
+		if msg := sameCapturesMessage(a.Checksum, b.Checksum, diffs); msg != "" {
+			fmt.Printf("# Diff - %s\n", msg)
+		}
+		return nil
+	}
+
+	if err := writeDiff(os.Stdout, versionA, versionB, b.Query, t.filter, diffs); err != nil {
+		return err
+	}
+
+	if t.options.DiffDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(t.options.DiffDir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("diff_%s_%s_%s.diff",
+		fileName(versionA), fileName(versionB), fileName(b.ID))
+	f, err := os.Create(filepath.Join(t.options.DiffDir, name))
+	if err != nil {
+		return err
+	}
+
+	if err := writeDiff(f, versionA, versionB, b.Query, t.filter, diffs); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+var regFileName = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// fileName converts a version or query ID to a string usable as file name.
+func fileName(s string) string {
+	return regFileName.ReplaceAllString(s, "_")
+}
+
 func (t *Test) runQueryCtx(
 	ctx context.Context,
 	gitbase *regression.Binary,
 	gitbaseEnvs map[string]string,
-	repos string,
+	repos []RepoRoot,
 	query Query,
 ) error {
 	t.log.Infof("Executing gitbase test")
 
-	server := NewServer(gitbase.Path, repos)
+	server := NewServer(gitbase.Path, repos...)
 	err := server.Start(gitbaseEnvs)
 	if err != nil {
 		t.log.With(log.Fields{
-			"repos":   repos,
+			"repos":   rootsString(repos),
 			"gitbase": gitbase.Path,
 		}).Errorf(err, "Could not execute gitbase")
 		return err
@@ -297,6 +818,7 @@ func (t *Test) runQueryCtx(
 	queries := NewSQLTest(server.URL(), query)
 	err = queries.Connect()
 	if err != nil {
+		server.Stop()
 		return err
 	}
 
@@ -315,60 +837,263 @@ func (t *Test) runQueryCtx(
 
 func (t *Test) runLoadTest(
 	gitbase *regression.Binary,
-	repos string,
+	repos []RepoRoot,
 	query Query,
+	capture int,
 ) (*Result, error) {
 	t.log.Infof("Executing gitbase test")
 
-	server := NewServer(gitbase.Path, repos)
+	server, err := t.startServer(gitbase, repos)
+	if err != nil {
+		result := NewResult()
+		result.Query = query
+		return result.fail(StatusError, err), err
+	}
+
+	result, err := t.runServerQuery(server, query, capture, false)
+	server.Stop()
+	if err != nil {
+		return result, err
+	}
+
+	rusage := server.Rusage()
+
+	t.log.With(log.Fields{
+		"wall":   result.Wtime,
+		"memory": rusage.Maxrss,
+	}).Infof("Finished queries")
+
+	result.Stime = time.Duration(rusage.Stime.Nano())
+	result.Utime = time.Duration(rusage.Utime.Nano())
+	result.Memory = rusage.Maxrss * 1024
+	result.Startup = server.StartupTime
+	result.StartupMemory = server.StartupMemory
+	result.Disk = server.Disk
+
+	return result, nil
+}
+
+// startServer starts a server of the binary and waits until it is ready.
+// When a server of the binary exits or is not ready before the timeout the
+// error is saved and returned without starting new servers.
+func (t *Test) startServer(gitbase *regression.Binary, repos []RepoRoot) (*Server, error) {
+	if err := t.startError(gitbase); err != nil {
+		return nil, err
+	}
+
+	server := NewServer(gitbase.Path, repos...)
+	server.ReadyTimeout = t.options.ReadyTimeout
+	server.CPUs = t.cpus[gitbase]
+	server.Args = t.args[gitbase]
+	server.Version = t.binarySemver(gitbase)
+	if t.options.Profile {
+		server.PprofFlag = t.options.ProfileFlag
+	}
 	err := server.Start(nil)
 	if err != nil {
 		t.log.With(log.Fields{
-			"repos":   repos,
+			"repos":   rootsString(repos),
 			"gitbase": gitbase.Path,
 		}).Errorf(err, "Could not execute gitbase")
+
+		if ErrNotReady.Is(err) || ErrServerExited.Is(err) {
+			t.mu.Lock()
+			if t.startErrors == nil {
+				t.startErrors = make(map[*regression.Binary]error)
+			}
+			t.startErrors[gitbase] = err
+			t.mu.Unlock()
+		}
+
 		return nil, err
 	}
 
+	t.log.With(log.Fields{
+		"startup": server.StartupTime,
+		"memory":  server.StartupMemory,
+	}).Infof("Server ready")
+
+	return server, nil
+}
+
+// startError returns the error of the binary servers that could not
+// start or nil if they did not fail.
+func (t *Test) startError(gitbase *regression.Binary) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.startErrors[gitbase]
+}
+
+// binarySemver returns the semantic version of a gitbase binary or nil if
+// it is unknown.
+func (t *Test) binarySemver(gitbase *regression.Binary) *semver.Version {
+	for version, b := range t.gitbase {
+		if b == gitbase {
+			return t.semvers[version]
+		}
+	}
+
+	return nil
+}
+
+// runServerQuery runs a query in an already started server. The result
+// only has the wall time. When warm is true the cpu times and peak memory
+// used by the server while running the statements are also filled from its
+// /proc counters. The server is stopped if the query times out.
+func (t *Test) runServerQuery(
+	server *Server,
+	query Query,
+	capture int,
+	warm bool,
+) (*Result, error) {
+	result := NewResult()
+	result.Query = query
+	result.Args = server.Args
+
 	queries := NewSQLTest(server.URL(), query)
-	err = queries.Connect()
+	queries.Capture = capture
+	err := queries.Connect()
 	if err != nil {
-		return nil, err
+		return result.fail(StatusError, err), err
 	}
 
-	start := time.Now()
+	timeout := t.timeout(query)
 
-	rows, err := queries.Execute()
+	setupCtx, cancel := withTimeout(timeout)
+	err = queries.Setup(setupCtx)
+	expired := setupCtx.Err() == context.DeadlineExceeded
+	cancel()
 	if err != nil {
-		return nil, err
+		result.SetupError = err.Error()
+		if expired {
+			// as with the statements the server may still be running
+			// the setup, it is killed so it is not reused
+			server.Stop()
+			queries.Disconnect()
+			err = ErrTimeout.New(query.ID, timeout)
+			return result.fail(StatusTimeout, err), err
+		}
+
+		queries.Disconnect()
+		return result.fail(StatusSetupError, err), err
+	}
+
+	var before *procUsage
+	if warm {
+		before = t.procUsage(server, true)
+	}
+
+	ctx, cancel := withTimeout(timeout)
+	defer cancel()
+
+	var samples *sampler
+	if t.options.SampleInterval > 0 && server.Pid() != 0 {
+		samples = startSampler(server.Pid(), t.options.SampleInterval)
 	}
 
+	start := time.Now()
+
+	out, err := queries.ExecuteCtx(ctx)
+
 	wall := time.Since(start)
 
+	if samples != nil {
+		result.Samples = samples.Stop()
+	}
+
+	// a run that finished just as the deadline passed is not a timeout
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		// the server may still be executing the query, it is killed
+		// before closing the connection
+		server.Stop()
+		queries.Disconnect()
+		err = ErrTimeout.New(query.ID, timeout)
+		return result.fail(StatusTimeout, err), err
+	}
+
+	var after *procUsage
+	if warm {
+		after = t.procUsage(server, false)
+	}
+
+	teardownCtx, cancel := withTimeout(timeout)
+	if terr := queries.Teardown(teardownCtx); terr != nil {
+		t.log.Errorf(terr, "Teardown failed")
+		result.TeardownError = terr.Error()
+	}
+	cancel()
+
 	queries.Disconnect()
-	server.Stop()
 
-	rusage := server.Rusage()
+	if err != nil {
+		return result.fail(StatusError, err), err
+	}
 
-	t.log.With(log.Fields{
-		"wall":   wall,
-		"memory": rusage.Maxrss,
-	}).Infof("Finished queries")
+	result.Wtime = wall
+	result.Rows = out.Rows
+	result.Checksum = out.Checksum
+	result.Tables = out.Tables
+	result.Timings = out.Timings
+
+	if warm {
+		disk, err := readDiskUsage(server.IndexPath())
+		if err != nil {
+			t.log.Errorf(err, "Could not read index directory usage")
+		}
+		result.Disk = disk
+	}
+
+	if before != nil && after != nil {
+		result.Utime = after.Utime - before.Utime
+		result.Stime = after.Stime - before.Stime
+		result.Memory = after.PeakRSS
+
+		t.log.With(log.Fields{
+			"wall":   wall,
+			"memory": result.Memory,
+		}).Infof("Finished queries")
+	}
+
+	return result, nil
+}
+
+// procUsage reads the counters of the server process. When reset is true
+// the peak memory is reset first. Errors are logged and nil returned.
+func (t *Test) procUsage(server *Server, reset bool) *procUsage {
+	if reset {
+		if err := resetPeakRSS(server.Pid()); err != nil {
+			t.log.Warningf("Could not reset peak memory, using process peak: %s", err)
+		}
+	}
+
+	usage, err := readProcUsage(server.Pid())
+	if err != nil {
+		t.log.Errorf(err, "Could not read server resource usage")
+		return nil
+	}
 
-	result := &regression.Result{
-		Wtime:  wall,
-		Stime:  time.Duration(rusage.Stime.Nano()),
-		Utime:  time.Duration(rusage.Utime.Nano()),
-		Memory: rusage.Maxrss * 1024,
+	return usage
+}
+
+// timeout returns the timeout of a query or the default one if it does not
+// have it.
+func (t *Test) timeout(query Query) time.Duration {
+	if query.Timeout > 0 {
+		return query.Timeout
 	}
 
-	r := &Result{
-		Result: result,
-		Query:  query,
-		Rows:   rows,
+	return t.options.Timeout
+}
+
+// withTimeout returns a context that expires after timeout or a context
+// without deadline if timeout is 0.
+func withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
 	}
 
-	return r, nil
+	return context.WithTimeout(context.Background(), timeout)
 }
 
 func (t *Test) prepareRepos() error {
@@ -378,8 +1103,43 @@ func (t *Test) prepareRepos() error {
 		return err
 	}
 
-	t.testRepos, err = t.repos.LinksDir()
-	return err
+	dir, err := t.repos.LinksDir()
+	if err != nil {
+		return err
+	}
+
+	dirs := []string{dir}
+	if t.options.ReposSplit > 1 {
+		dirs, err = splitRepos(dir, t.options.ReposSplit)
+		if err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			t.log.Errorf(err, "Could not remove repositories directory")
+		}
+	}
+
+	t.testRepos = nil
+	for _, d := range dirs {
+		root := RepoRoot{Path: d, Format: t.options.ReposFormat}
+		if root.Format == RepoFormatSiva {
+			t.log.With(log.Fields{"path": d}).Infof("Converting repositories to siva")
+			root.Path, err = sivaRepos(t.log, d)
+			if err != nil {
+				return err
+			}
+
+			if err := os.RemoveAll(d); err != nil {
+				t.log.Errorf(err, "Could not remove plain repositories")
+			}
+		}
+
+		t.testRepos = append(t.testRepos, root)
+	}
+
+	t.testRepos = append(t.testRepos, t.extraRoots...)
+	return nil
 }
 
 func (t *Test) prepareGitbase() error {
@@ -387,6 +1147,9 @@ func (t *Test) prepareGitbase() error {
 	releases := regression.NewReleases("src-d", "gitbase", t.config.GitHubToken)
 
 	t.gitbase = make(map[string]*regression.Binary, len(t.config.Versions))
+	t.semvers = make(map[string]*semver.Version, len(t.config.Versions))
+	t.builds = make(map[string]time.Time, len(t.config.Versions))
+	t.args = make(map[*regression.Binary][]string, len(t.config.Versions))
 	for _, version := range t.config.Versions {
 		b := NewGitbase(t.config, version, releases)
 		err := b.Download()
@@ -395,6 +1158,33 @@ func (t *Test) prepareGitbase() error {
 		}
 
 		t.gitbase[version] = b
+		t.args[b] = t.versionArgs(version)
+
+		l := t.log.New(log.Fields{"version": version})
+		if len(t.args[b]) > 0 {
+			l.With(log.Fields{
+				"args": formatArgs(t.args[b]),
+			}).Infof("Using extra gitbase arguments")
+		}
+		v, build, err := gitbaseVersion(b)
+		switch {
+		case err != nil:
+			l.Errorf(err, "Could not get gitbase version, running all queries")
+		case v == nil && build.IsZero():
+			l.Warningf("Unknown gitbase version, running all queries")
+		default:
+			l.With(log.Fields{
+				"semver": v,
+				"build":  build.Format(buildLayouts[0]),
+			}).Infof("Resolved gitbase version")
+		}
+
+		if err := checkRoots(t.testRepos, v); err != nil {
+			return err
+		}
+
+		t.semvers[version] = v
+		t.builds[version] = build
 	}
 
 	return nil
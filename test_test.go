@@ -1,12 +1,178 @@
 package gitbase
 
 import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	regression "github.com/src-d/regression-core"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-log.v1"
 )
 
+// newFakeTest returns a test that runs queries in fake mysql servers.
+func newFakeTest(t *testing.T, options Options) (*Test, *regression.Binary, func()) {
+	path, clean := fakeMySQL(t)
+
+	l, err := (&log.LoggerFactory{Level: log.ErrorLevel}).New(log.Fields{})
+	require.NoError(t, err)
+
+	test := &Test{options: options, log: l}
+	return test, &regression.Binary{Version: "fake", Path: path}, clean
+}
+
+func TestRunServerQueryTimeout(t *testing.T) {
+	require := require.New(t)
+
+	test, gitbase, clean := newFakeTest(t, Options{Timeout: 300 * time.Millisecond})
+	defer clean()
+
+	server, err := test.startServer(gitbase, nil)
+	require.NoError(err)
+	defer server.Stop()
+
+	query := Query{ID: "error", Statements: []string{"SELECT ERROR"}}
+	result, err := test.runServerQuery(server, query, 0, false)
+	require.Error(err)
+	require.Equal(StatusError, result.Status)
+	require.Contains(result.Error, "fake error")
+	require.True(server.Alive())
+
+	query = Query{ID: "sleep", Statements: []string{"SELECT SLEEP(10)"}}
+	result, err = test.runServerQuery(server, query, 0, false)
+	require.True(ErrTimeout.Is(err), "unexpected error: %v", err)
+	require.Equal(StatusTimeout, result.Status)
+	require.False(server.Alive(), "server not killed after timeout")
+}
+
+func TestRunServerQuerySetup(t *testing.T) {
+	require := require.New(t)
+
+	test, gitbase, clean := newFakeTest(t, Options{})
+	defer clean()
+
+	server, err := test.startServer(gitbase, nil)
+	require.NoError(err)
+	defer server.Stop()
+
+	// teardown errors are reported but the run succeeds
+	query := Query{
+		ID:         "teardown",
+		Setup:      []string{"SET setup = 1"},
+		Statements: []string{"SELECT 1"},
+		Teardown:   []string{"SET ERROR = 1"},
+	}
+	result, err := test.runServerQuery(server, query, 0, false)
+	require.NoError(err)
+	require.Equal(StatusOK, result.Status)
+	require.Empty(result.SetupError)
+	require.Contains(result.TeardownError, "fake error")
+
+	// statements are not run after a setup error
+	query = Query{
+		ID:         "setup",
+		Setup:      []string{"SET ERROR = 1"},
+		Statements: []string{"SELECT 2"},
+	}
+	result, err = test.runServerQuery(server, query, 0, false)
+	require.Error(err)
+	require.Equal(StatusSetupError, result.Status)
+	require.Contains(result.SetupError, "fake error")
+
+	queries, err := ioutil.ReadFile(filepath.Join(filepath.Dir(gitbase.Path), "queries"))
+	require.NoError(err)
+	require.Equal("SET setup = 1\nSELECT 1\nSET ERROR = 1\nSET ERROR = 1\n", string(queries))
+}
+
+func TestRunVersionStartError(t *testing.T) {
+	require := require.New(t)
+
+	path, clean := fakeGitbase(t, `echo started >> "$(dirname "$0")/starts"; exit 1`)
+	defer clean()
+
+	dir := filepath.Dir(path)
+	queries := filepath.Join(dir, "queries.yml")
+	err := ioutil.WriteFile(queries, []byte(`
+- ID: a
+  Statements: [select 1]
+- ID: b
+  Statements: [select 2]
+`), 0644)
+	require.NoError(err)
+
+	options := Options{
+		Queries:        []string{queries},
+		ReplaceQueries: true,
+		Warmup:         1,
+	}
+	filter, err := NewFilter(options)
+	require.NoError(err)
+
+	l, err := (&log.LoggerFactory{Level: log.ErrorLevel}).New(log.Fields{})
+	require.NoError(err)
+
+	test := &Test{
+		config:   regression.Config{Repeat: 3},
+		gitbase:  map[string]*regression.Binary{"fake": {Version: "fake", Path: path}},
+		catalogs: make(map[string][]Query),
+		options:  options,
+		filter:   filter,
+		log:      l,
+	}
+
+	results, err := test.runVersion("fake")
+	require.NoError(err)
+
+	for _, id := range []string{"a", "b"} {
+		require.Len(results[id], 1)
+		require.Equal(StatusError, results[id][0].Status)
+		require.Contains(results[id][0].Error, "exited before being ready")
+	}
+
+	// the server is only started once
+	starts, err := ioutil.ReadFile(filepath.Join(dir, "starts"))
+	require.NoError(err)
+	require.Equal(1, strings.Count(string(starts), "started"))
+}
+
+func TestGetResultsStatus(t *testing.T) {
+	require := require.New(t)
+
+	query := Query{ID: "query", Statements: []string{"SELECT 1"}}
+	result := func(status Status) []*Result {
+		r := NewResult()
+		r.Query = query
+		r.Status = status
+		if status != StatusOK {
+			r.Error = "failed"
+		}
+		return []*Result{r}
+	}
+
+	test := &Test{
+		config: regression.Config{Versions: []string{"a", "b", "c"}},
+		catalogs: map[string][]Query{
+			"a": {query},
+			"b": {query},
+			"c": {query},
+		},
+		results: versionResults{
+			"a": {"query": result(StatusTimeout)},
+			"b": {"query": result(StatusOK)},
+			"c": {"query": result(StatusOK)},
+		},
+		filter: new(Filter),
+	}
+
+	// a query that failed in the old version and succeeds now passes
+	require.True(test.GetResults())
+
+	test.results["c"]["query"] = result(StatusError)
+	require.False(test.GetResults())
+}
+
 func TestTest(t *testing.T) {
 	require := require.New(t)
 
@@ -18,7 +184,7 @@ func TestTest(t *testing.T) {
 	test, err := NewTest(config, regression.GitServerConfig{
 		RepositoriesCache: "repo",
 		Complexity:        0,
-	})
+	}, Options{})
 	require.NoError(err)
 
 	err = test.Prepare()
@@ -0,0 +1,92 @@
+package gitbase
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/src-d/regression-core"
+)
+
+var (
+	regVersion = regexp.MustCompile(`v?\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?`)
+	regBuild   = regexp.MustCompile(`build\s+(\S+)`)
+)
+
+// buildLayouts are the formats of the build dates found in the output of
+// "gitbase version". The first one is also used in query version ranges.
+var buildLayouts = []string{
+	"2006-01-02",
+	time.RFC3339,
+	"01-02-2006_15_04_05",
+}
+
+// gitbaseVersion returns the semantic version and build date of a gitbase
+// binary. Release versions are parsed directly, for the rest the output of
+// "gitbase version" is used. The version is nil and the date is zero when
+// they can not be resolved, for example with development builds.
+func gitbaseVersion(b *regression.Binary) (*semver.Version, time.Time, error) {
+	out, err := versionOutput(b)
+
+	if b.IsRelease() {
+		v, verr := semver.NewVersion(b.Version)
+		if verr != nil || err != nil {
+			// the build date is optional for releases
+			return v, time.Time{}, verr
+		}
+
+		return v, parseBuild(out), nil
+	}
+
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return parseVersion(out), parseBuild(out), nil
+}
+
+func versionOutput(b *regression.Binary) (string, error) {
+	e, err := regression.NewExecutor(b.Path, "version")
+	if err != nil {
+		return "", err
+	}
+
+	if err := e.Run(); err != nil {
+		return "", err
+	}
+
+	return e.Out()
+}
+
+// parseVersion returns the first semantic version found in the text or nil
+// if there is none.
+func parseVersion(text string) *semver.Version {
+	match := regVersion.FindString(text)
+	if match == "" {
+		return nil
+	}
+
+	v, err := semver.NewVersion(match)
+	if err != nil {
+		return nil
+	}
+
+	return v
+}
+
+// parseBuild returns the build date found in the text or a zero time if
+// there is none.
+func parseBuild(text string) time.Time {
+	match := regBuild.FindStringSubmatch(text)
+	if match == nil {
+		return time.Time{}
+	}
+
+	for _, layout := range buildLayouts {
+		if t, err := time.Parse(layout, match[1]); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
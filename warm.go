@@ -0,0 +1,66 @@
+package gitbase
+
+import (
+	"github.com/src-d/regression-core"
+)
+
+// warmServer keeps a gitbase server running between query runs. A new
+// server is started when the previous one is not alive, for example after
+// a query timeout.
+type warmServer struct {
+	test    *Test
+	gitbase *regression.Binary
+	repos   []RepoRoot
+	server  *Server
+	// started is true when the server startup was not reported yet
+	started bool
+}
+
+// run executes a query in the running server, starting it if needed. The
+// first result after the server starts has its startup metrics.
+func (w *warmServer) run(query Query, capture int) (*Result, error) {
+	return w.runQuery(query, capture, true)
+}
+
+// warmup runs a query without reporting the server startup.
+func (w *warmServer) warmup(query Query) (*Result, error) {
+	return w.runQuery(query, 0, false)
+}
+
+func (w *warmServer) runQuery(query Query, capture int, measured bool) (*Result, error) {
+	if w.server == nil || !w.server.Alive() {
+		w.stop()
+
+		server, err := w.test.startServer(w.gitbase, w.repos)
+		if err != nil {
+			result := NewResult()
+			result.Query = query
+			return result.fail(StatusError, err), err
+		}
+
+		w.server = server
+		w.started = true
+	}
+
+	result, err := w.test.runServerQuery(w.server, query, capture, true)
+	if measured && w.started {
+		result.Startup = w.server.StartupTime
+		result.StartupMemory = w.server.StartupMemory
+		w.started = false
+	}
+
+	return result, err
+}
+
+// stop stops the running server if there is one.
+func (w *warmServer) stop() {
+	if w.server == nil {
+		return
+	}
+
+	if err := w.server.Stop(); err != nil {
+		w.test.log.Errorf(err, "Could not stop gitbase")
+	}
+
+	w.server = nil
+}